@@ -2,6 +2,7 @@ use axum::{
     routing::{delete, get, post},
     Router,
 };
+use std::path::Path;
 use std::sync::Arc;
 use tower::ServiceBuilder;
 use tower_http::{cors::CorsLayer, trace::TraceLayer};
@@ -92,6 +93,64 @@ pub fn create_router(config: Arc<Config>, host: &str, port: u16) -> Router {
         .with_state(state)
 }
 
+/// Mode of the API socket: the owner and its group (e.g. a CI runner
+/// account) may connect, nobody else.
+const SOCKET_MODE: u32 = 0o660;
+
+/// Serve `app` on a unix domain socket instead of TCP. For local-only
+/// consumers (CI runners, the Packer plugin) this avoids exposing the
+/// API on a port at all; access is limited to the owner and group by
+/// the socket's mode ([`SOCKET_MODE`]). A stale socket left by a
+/// previous run is replaced; anything else at the path is left alone.
+///
+/// axum 0.7's `serve` only takes a `TcpListener`, so connections are
+/// driven through hyper directly (same as axum's unix-socket example).
+pub async fn serve_unix(app: Router, path: &Path) -> std::io::Result<()> {
+    use hyper_util::rt::{TokioExecutor, TokioIo};
+    use hyper_util::server::conn::auto::Builder;
+    use std::io::{Error, ErrorKind};
+    use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+    use tower::ServiceExt;
+
+    match std::fs::symlink_metadata(path) {
+        Ok(meta) if !meta.file_type().is_socket() => {
+            return Err(Error::new(
+                ErrorKind::AlreadyExists,
+                format!("{} exists and is not a socket", path.display()),
+            ));
+        }
+        Ok(_) => {
+            if std::os::unix::net::UnixStream::connect(path).is_ok() {
+                return Err(Error::new(
+                    ErrorKind::AddrInUse,
+                    format!("{} is in use by another server", path.display()),
+                ));
+            }
+            std::fs::remove_file(path)?;
+        }
+        Err(e) if e.kind() == ErrorKind::NotFound => {}
+        Err(e) => return Err(e),
+    }
+    let listener = tokio::net::UnixListener::bind(path)?;
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(SOCKET_MODE))?;
+
+    loop {
+        let (stream, _) = listener.accept().await?;
+        let app = app.clone();
+        tokio::spawn(async move {
+            let service = hyper::service::service_fn(
+                move |request: hyper::Request<hyper::body::Incoming>| app.clone().oneshot(request),
+            );
+            if let Err(e) = Builder::new(TokioExecutor::new())
+                .serve_connection_with_upgrades(TokioIo::new(stream), service)
+                .await
+            {
+                log::debug!("unix socket connection error: {}", e);
+            }
+        });
+    }
+}
+
 /// OpenAPI documentation
 #[derive(OpenApi)]
 #[openapi(
@@ -173,3 +232,45 @@ fn create_swagger_ui(base_url: &str) -> Router<AppState> {
         .url("/api/v1/openapi.json", openapi)
         .into()
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_serve_unix_refuses_non_socket_and_live_socket() {
+        let temp_dir = TempDir::new().unwrap();
+
+        let file = temp_dir.path().join("api.sock");
+        std::fs::write(&file, "not a socket").unwrap();
+        let err = serve_unix(Router::new(), &file).await.unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::AlreadyExists);
+        assert_eq!(std::fs::read_to_string(&file).unwrap(), "not a socket");
+
+        let live = temp_dir.path().join("live.sock");
+        let _listener = std::os::unix::net::UnixListener::bind(&live).unwrap();
+        let err = serve_unix(Router::new(), &live).await.unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::AddrInUse);
+        assert!(live.exists());
+    }
+
+    #[tokio::test]
+    async fn test_serve_unix_sets_socket_mode() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("api.sock");
+
+        // The server only returns on error; give it long enough to bind.
+        let served = tokio::time::timeout(
+            std::time::Duration::from_millis(500),
+            serve_unix(Router::new(), &path),
+        )
+        .await;
+        assert!(served.is_err(), "server stopped: {:?}", served);
+        let mode = std::fs::metadata(&path)
+            .map(|meta| meta.permissions().mode() & 0o777)
+            .ok();
+        assert_eq!(mode, Some(0o660));
+    }
+}
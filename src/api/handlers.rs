@@ -7,6 +7,7 @@ use log::{error, info};
 
 use super::{models::*, AppState};
 use crate::admission::{self, AdmissionDenied, Committed, VmRequest};
+use crate::cloud_init::CloudInitOptions;
 use crate::{image, vm};
 
 /// List all VMs
@@ -109,19 +110,80 @@ pub async fn create_vm(
     }
 
     // Create VmResources from request
-    let resources = vm::VmResources::from_config_with_overrides(
+    let resources = match vm::VmResources::from_config_with_overrides(
         &state.config,
         request.memory.as_deref(),
         request.cpus,
         request.disk.as_deref(),
         request.devices,
-    );
+    )
+    .with_memory_options(request.memory_backing.as_deref(), request.swap.as_deref())
+    .and_then(|resources| {
+        resources.with_host_limits(
+            request.cpu_quota.as_deref(),
+            request.memory_limit.as_deref(),
+        )
+    })
+    .and_then(|resources| resources.with_placement(request.cpuset.as_deref(), request.numa_node))
+    .and_then(|resources| {
+        resources
+            .with_tpm(request.tpm)
+            .with_subnet(request.subnet.as_deref())
+    }) {
+        Ok(resources) => resources,
+        Err(e) => {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError {
+                    error: "Invalid VM resources".to_string(),
+                    code: "INVALID_RESOURCES".to_string(),
+                    details: Some(serde_json::json!({"message": e.to_string()})),
+                }),
+            ));
+        }
+    };
+
+    let extra_keys =
+        crate::ssh::extra_authorized_keys(&request.authorized_keys_from_github, false).await;
+    let cloud_init = match CloudInitOptions::default()
+        .with_metadata_source(request.metadata_source.as_deref())
+        .and_then(|options| {
+            options.with_credentials(
+                request.guest_user.as_deref(),
+                request.guest_password.as_deref(),
+            )
+        })
+        .and_then(|options| options.with_dns(&request.dns_servers, &request.dns_search))
+        .and_then(|options| {
+            options.with_proxy(
+                request.http_proxy.as_deref(),
+                request.https_proxy.as_deref(),
+                request.no_proxy.as_deref(),
+            )
+        })
+        .and_then(|options| options.with_timezone(request.timezone.as_deref()))
+        .and_then(|options| options.with_hostname(request.hostname.as_deref()))
+        .and_then(|options| options.with_authorized_keys(extra_keys?))
+    {
+        Ok(cloud_init) => cloud_init,
+        Err(e) => {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError {
+                    error: "Invalid cloud-init options".to_string(),
+                    code: "INVALID_CLOUD_INIT".to_string(),
+                    details: Some(serde_json::json!({"message": e.to_string()})),
+                }),
+            ));
+        }
+    };
 
     match vm::create(
         &state.config,
         &request.name,
         request.user_data.as_deref(),
         &resources,
+        &cloud_init,
         true,
     )
     .await
@@ -375,7 +437,7 @@ pub async fn get_vm_ip(
     State(state): State<AppState>,
     Path(name): Path<String>,
 ) -> Result<Json<serde_json::Value>, (StatusCode, Json<ApiError>)> {
-    match vm::ip(&state.config, &name, true).await {
+    match vm::ip(&state.config, &name, vm::IpSource::Auto, None, true).await {
         Ok(_) => {
             // Get IP directly — must mirror `meda ip`'s priority chain
             // (netns IP first) so REST clients get a host-routable IP.
@@ -518,7 +580,67 @@ pub async fn create_image(
     let default_registry = request.registry.as_deref().unwrap_or("ghcr.io");
     let default_org = request.org.as_deref().unwrap_or("cirunlabs");
 
+    let needs_vm = from_vm_only_fields(&request);
+    if request.from_vm.is_none() && !needs_vm.is_empty() {
+        return Err((
+            StatusCode::BAD_REQUEST,
+            Json(ApiError {
+                error: "Invalid image create request".to_string(),
+                code: "INVALID_REQUEST".to_string(),
+                details: Some(serde_json::json!({
+                    "message": format!("{} require from_vm", needs_vm.join(", "))
+                })),
+            }),
+        ));
+    }
+
+    let parsed = request
+        .zero_free_space
+        .as_deref()
+        .map(image::ZeroFreeSpace::parse)
+        .transpose()
+        .and_then(|technique| {
+            let max_size = request
+                .max_size
+                .as_deref()
+                .map(crate::util::parse_size_bytes)
+                .transpose()?;
+            let guest_os = request
+                .guest_os
+                .as_deref()
+                .map(image::parse_guest_os)
+                .transpose()?;
+            Ok((technique, max_size, guest_os))
+        });
+    let (zero_free_space, max_size, guest_os) = match parsed {
+        Ok(parsed) => parsed,
+        Err(e) => {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError {
+                    error: "Invalid image create request".to_string(),
+                    code: "INVALID_REQUEST".to_string(),
+                    details: Some(serde_json::json!({"message": e.to_string()})),
+                }),
+            ));
+        }
+    };
+
     let result = if let Some(vm_name) = request.from_vm {
+        let options = image::CreateImageOptions {
+            skip_if_exists: request.skip_if_exists,
+            inputs_hash: request.inputs_hash,
+            allow_base_overwrite: request.allow_base_overwrite,
+            zero_free_space,
+            seal_commands: image::seal_commands(request.seal, request.seal_commands),
+            source_date_epoch: request.source_date_epoch,
+            max_size,
+            delta: request.delta,
+            guest_os,
+            // The server's own environment says nothing about the
+            // caller's CI run.
+            ci_environment: Default::default(),
+        };
         image::create_from_vm(
             &state.config,
             &vm_name,
@@ -526,6 +648,7 @@ pub async fn create_image(
             &request.tag,
             default_registry,
             default_org,
+            &options,
             true,
         )
         .await
@@ -570,6 +693,26 @@ pub async fn create_image(
     }
 }
 
+/// Fields of an image create request that only apply when building
+/// from a VM, as the CLI's `requires = "from_vm"` flags do.
+fn from_vm_only_fields(request: &ImageCreateRequest) -> Vec<&'static str> {
+    [
+        ("skip_if_exists", request.skip_if_exists),
+        ("inputs_hash", request.inputs_hash.is_some()),
+        ("allow_base_overwrite", request.allow_base_overwrite),
+        ("zero_free_space", request.zero_free_space.is_some()),
+        ("seal", request.seal),
+        ("seal_commands", !request.seal_commands.is_empty()),
+        ("source_date_epoch", request.source_date_epoch.is_some()),
+        ("max_size", request.max_size.is_some()),
+        ("delta", request.delta),
+        ("guest_os", request.guest_os.is_some()),
+    ]
+    .into_iter()
+    .filter_map(|(field, set)| set.then_some(field))
+    .collect()
+}
+
 /// Remove an image
 #[utoipa::path(
     delete,
@@ -674,12 +817,21 @@ pub async fn push_image(
     State(state): State<AppState>,
     Json(request): Json<ImagePushRequest>,
 ) -> Result<Json<VmResponse>, (StatusCode, Json<ApiError>)> {
+    let options = image::PushOptions {
+        also_tags: request.also_tags,
+        annotations: request.annotations,
+        remove_local: request.remove_local,
+        squash: request.squash,
+        tag_by_digest: request.tag_by_digest,
+        rollback_on_failure: request.rollback_on_failure,
+        dry_run: request.dry_run,
+    };
     match image::push(
         &state.config,
         &request.name,
         &request.image,
         request.registry.as_deref(),
-        request.dry_run,
+        &options,
         true,
     )
     .await
@@ -713,6 +865,7 @@ pub async fn push_image(
     request_body = ImagePruneRequest,
     responses(
         (status = 200, description = "Images pruned successfully", body = VmResponse),
+        (status = 400, description = "Bad request", body = ApiError),
         (status = 500, description = "Internal server error", body = ApiError)
     ),
     tag = "Images"
@@ -721,7 +874,30 @@ pub async fn prune_images(
     State(state): State<AppState>,
     Json(request): Json<ImagePruneRequest>,
 ) -> Result<Json<VmResponse>, (StatusCode, Json<ApiError>)> {
-    match image::prune(&state.config, request.all, request.force, true).await {
+    let older_than = match request
+        .older_than
+        .as_deref()
+        .map(crate::util::parse_duration_secs)
+        .transpose()
+    {
+        Ok(older_than) => older_than,
+        Err(e) => {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError {
+                    error: "Invalid prune policy".to_string(),
+                    code: "INVALID_PRUNE_POLICY".to_string(),
+                    details: Some(serde_json::json!({"message": e.to_string()})),
+                }),
+            ));
+        }
+    };
+    let policy = image::PrunePolicy {
+        keep_last: request.keep_last,
+        older_than,
+        name_prefix: request.name_prefix,
+    };
+    match image::prune(&state.config, request.all, &policy, request.force, true).await {
         Ok(_) => {
             info!("Successfully pruned images");
             Ok(Json(VmResponse {
@@ -760,13 +936,36 @@ pub async fn run_from_image(
     State(state): State<AppState>,
     Json(request): Json<ImageRunRequest>,
 ) -> Response {
-    let resources = vm::VmResources::from_config_with_overrides(
+    let resources = match vm::VmResources::from_config_with_overrides(
         &state.config,
         request.memory.as_deref(),
         request.cpus,
         request.disk.as_deref(),
         request.devices.clone(),
-    );
+    )
+    .with_memory_options(request.memory_backing.as_deref(), request.swap.as_deref())
+    .and_then(|resources| {
+        resources.with_host_limits(
+            request.cpu_quota.as_deref(),
+            request.memory_limit.as_deref(),
+        )
+    })
+    .and_then(|resources| resources.with_placement(request.cpuset.as_deref(), request.numa_node))
+    .and_then(|resources| {
+        resources
+            .with_tpm(request.tpm)
+            .with_subnet(request.subnet.as_deref())
+    }) {
+        Ok(resources) => resources,
+        Err(e) => {
+            return api_error_response(
+                StatusCode::BAD_REQUEST,
+                "Invalid VM resources",
+                "INVALID_RESOURCES",
+                Some(serde_json::json!({"message": e.to_string()})),
+            );
+        }
+    };
 
     // Admission control: strict no-overcommit. If the host can't take
     // another VM of this size we return 503 + Retry-After instead of
@@ -807,6 +1006,39 @@ pub async fn run_from_image(
         }
     };
 
+    let extra_keys =
+        crate::ssh::extra_authorized_keys(&request.authorized_keys_from_github, false).await;
+    let cloud_init = match CloudInitOptions::default()
+        .with_metadata_source(request.metadata_source.as_deref())
+        .and_then(|options| {
+            options.with_credentials(
+                request.guest_user.as_deref(),
+                request.guest_password.as_deref(),
+            )
+        })
+        .and_then(|options| options.with_dns(&request.dns_servers, &request.dns_search))
+        .and_then(|options| {
+            options.with_proxy(
+                request.http_proxy.as_deref(),
+                request.https_proxy.as_deref(),
+                request.no_proxy.as_deref(),
+            )
+        })
+        .and_then(|options| options.with_timezone(request.timezone.as_deref()))
+        .and_then(|options| options.with_hostname(request.hostname.as_deref()))
+        .and_then(|options| options.with_authorized_keys(extra_keys?))
+    {
+        Ok(cloud_init) => cloud_init,
+        Err(e) => {
+            return api_error_response(
+                StatusCode::BAD_REQUEST,
+                "Invalid cloud-init options",
+                "INVALID_CLOUD_INIT",
+                Some(serde_json::json!({"message": e.to_string()})),
+            );
+        }
+    };
+
     let options = image::RunOptions {
         vm_name: request.name.as_deref(),
         registry: request.registry.as_deref(),
@@ -814,6 +1046,7 @@ pub async fn run_from_image(
         user_data_path: request.user_data.as_deref(),
         no_start: request.no_start,
         resources,
+        cloud_init,
     };
 
     // The CLI's `meda run` defaults to the snapshot/restore fast path
@@ -821,7 +1054,7 @@ pub async fn run_from_image(
     // cloud-init when `--no-start` is passed (snapshot/restore implies
     // running, so there's nothing to "not start"). Mirror that here so
     // API consumers get the same speed without an extra endpoint.
-    let result = if request.no_start {
+    let result = if options.needs_cold_boot() {
         image::run_from_image(&state.config, &request.image, options, true)
             .await
             .map(|_| serde_json::Value::Null)
@@ -998,6 +1231,7 @@ fn vm_info_from_run_summary(summary: &serde_json::Value) -> Option<VmInfo> {
         disk: String::new(),
         devices: Vec::new(),
         created: String::new(),
+        notes: None,
     })
 }
 
@@ -1089,6 +1323,8 @@ async fn get_vm_list(config: &crate::config::Config) -> crate::error::Result<Vec
                 Err(_) => "unknown".to_string(),
             };
 
+            let notes = vm::get_vm_notes(config, &name);
+
             vms.push(VmInfo {
                 name,
                 state,
@@ -1098,6 +1334,7 @@ async fn get_vm_list(config: &crate::config::Config) -> crate::error::Result<Vec
                 disk,
                 devices,
                 created,
+                notes,
             });
         }
     }
@@ -1182,6 +1419,25 @@ async fn get_vm_details(
 mod tests {
     use super::*;
 
+    #[test]
+    fn from_vm_only_fields_lists_what_needs_a_vm() {
+        let request: ImageCreateRequest = serde_json::from_value(serde_json::json!({
+            "name": "app",
+            "tag": "v1",
+            "skip_if_exists": true,
+            "inputs_hash": "abc123"
+        }))
+        .unwrap();
+        assert_eq!(
+            from_vm_only_fields(&request),
+            vec!["skip_if_exists", "inputs_hash"]
+        );
+
+        let base: ImageCreateRequest =
+            serde_json::from_value(serde_json::json!({"name": "app", "tag": "v1"})).unwrap();
+        assert!(from_vm_only_fields(&base).is_empty());
+    }
+
     #[test]
     fn vm_info_from_summary_extracts_name_and_host() {
         let summary = serde_json::json!({
@@ -20,6 +20,48 @@ pub struct VmCreateRequest {
     /// VFIO device paths for PCI passthrough
     #[serde(default)]
     pub devices: Vec<String>,
+    /// Guest memory backing: default, hugepages or shared (optional)
+    pub memory_backing: Option<String>,
+    /// Guest swap file size, e.g. 2G (optional)
+    pub swap: Option<String>,
+    /// Host-side CPU cap for the VM process, e.g. 200% (optional)
+    pub cpu_quota: Option<String>,
+    /// Host-side memory cap for the VM process, e.g. 6G (optional)
+    pub memory_limit: Option<String>,
+    /// Host CPUs to pin the VM process to, e.g. 0-3,8 (optional)
+    pub cpuset: Option<String>,
+    /// Host NUMA node for guest RAM (optional)
+    pub numa_node: Option<u32>,
+    /// Attach a TPM 2.0 emulated by swtpm
+    #[serde(default)]
+    pub tpm: bool,
+    /// Pin the VM to this subnet, e.g. 192.168.77 (optional)
+    pub subnet: Option<String>,
+    /// Cloud-init datasource: nocloud or configdrive (optional)
+    pub metadata_source: Option<String>,
+    /// Login user for the default user-data instead of cirun (optional)
+    pub guest_user: Option<String>,
+    /// Password for the guest user; enables SSH password auth (optional)
+    pub guest_password: Option<String>,
+    /// Nameservers for the guest (default: the host's)
+    #[serde(default)]
+    pub dns_servers: Vec<String>,
+    /// DNS search domains for the guest
+    #[serde(default)]
+    pub dns_search: Vec<String>,
+    /// HTTP proxy for the guest (optional)
+    pub http_proxy: Option<String>,
+    /// HTTPS proxy for the guest (optional)
+    pub https_proxy: Option<String>,
+    /// Comma-separated hosts that bypass the guest proxy (optional)
+    pub no_proxy: Option<String>,
+    /// Guest timezone as a tz database name; also syncs the guest clock (optional)
+    pub timezone: Option<String>,
+    /// GitHub users whose public SSH keys are also authorised in the guest
+    #[serde(default)]
+    pub authorized_keys_from_github: Vec<String>,
+    /// Guest hostname instead of the VM name (optional)
+    pub hostname: Option<String>,
 }
 
 /// VM response information
@@ -52,6 +94,8 @@ pub struct VmInfo {
     pub devices: Vec<String>,
     /// Creation time
     pub created: String,
+    /// Free-form note attached to the VM
+    pub notes: Option<String>,
 }
 
 /// VM list response
@@ -123,6 +167,35 @@ pub struct ImageCreateRequest {
     pub org: Option<String>,
     /// Create from existing VM instead of base image
     pub from_vm: Option<String>,
+    /// Keep the existing image instead of rebuilding when the target
+    /// name:tag already exists locally (only with from_vm)
+    #[serde(default)]
+    pub skip_if_exists: bool,
+    /// Hash of the build inputs, recorded in the image manifest; with
+    /// skip_if_exists it decides whether a cached image is stale
+    pub inputs_hash: Option<String>,
+    /// Allow the target to be the image the source VM was created from
+    #[serde(default)]
+    pub allow_base_overwrite: bool,
+    /// Reclaim free space in the running VM before imaging: trim or zero
+    pub zero_free_space: Option<String>,
+    /// Seal the running VM with the default seal commands before imaging
+    #[serde(default)]
+    pub seal: bool,
+    /// Custom seal commands run instead of the defaults (implies seal)
+    #[serde(default)]
+    pub seal_commands: Vec<String>,
+    /// SOURCE_DATE_EPOCH to pin the image to (clamps guest file mtimes
+    /// and sets the creation time)
+    pub source_date_epoch: Option<u64>,
+    /// Fail instead of saving the image if it takes more than this much
+    /// disk, e.g. 8G (optional)
+    pub max_size: Option<String>,
+    /// Store the image as a qcow2 delta on the image the VM was run from
+    #[serde(default)]
+    pub delta: bool,
+    /// Guest OS family to record instead of detecting it (optional)
+    pub guest_os: Option<String>,
 }
 
 /// Request to pull an image
@@ -145,6 +218,25 @@ pub struct ImagePushRequest {
     pub image: String,
     /// Registry URL (optional)
     pub registry: Option<String>,
+    /// Extra tags to point at the pushed image, e.g. ["latest"]
+    #[serde(default)]
+    pub also_tags: Vec<String>,
+    /// Manifest annotations as key=value, e.g. ["org.opencontainers.image.revision=abc123"]
+    #[serde(default)]
+    pub annotations: Vec<String>,
+    /// Delete the local image after a verified push
+    #[serde(default)]
+    pub remove_local: bool,
+    /// Upload each artifact as a single layer (no chunking)
+    #[serde(default)]
+    pub squash: bool,
+    /// Also tag the image sha256-<hex> after its manifest digest
+    #[serde(default)]
+    pub tag_by_digest: bool,
+    /// Undo the push (restore moved tags, delete the pushed manifest
+    /// unless another tag uses it) if the extra tags fail
+    #[serde(default)]
+    pub rollback_on_failure: bool,
     /// Dry run - don't actually push
     #[serde(default)]
     pub dry_run: bool,
@@ -156,6 +248,12 @@ pub struct ImagePruneRequest {
     /// Remove all images (not just unused ones)
     #[serde(default)]
     pub all: bool,
+    /// Keep only the newest N tags of each image name (optional)
+    pub keep_last: Option<usize>,
+    /// Only remove images older than this, e.g. 7d (optional)
+    pub older_than: Option<String>,
+    /// Only consider images whose name starts with this (optional)
+    pub name_prefix: Option<String>,
     /// Don't prompt for confirmation
     #[serde(default)]
     pub force: bool,
@@ -186,6 +284,48 @@ pub struct ImageRunRequest {
     /// VFIO device paths for PCI passthrough
     #[serde(default)]
     pub devices: Vec<String>,
+    /// Guest memory backing: default, hugepages or shared (optional)
+    pub memory_backing: Option<String>,
+    /// Guest swap file size, e.g. 2G (optional)
+    pub swap: Option<String>,
+    /// Host-side CPU cap for the VM process, e.g. 200% (optional)
+    pub cpu_quota: Option<String>,
+    /// Host-side memory cap for the VM process, e.g. 6G (optional)
+    pub memory_limit: Option<String>,
+    /// Host CPUs to pin the VM process to, e.g. 0-3,8 (optional)
+    pub cpuset: Option<String>,
+    /// Host NUMA node for guest RAM (optional)
+    pub numa_node: Option<u32>,
+    /// Attach a TPM 2.0 emulated by swtpm
+    #[serde(default)]
+    pub tpm: bool,
+    /// Pin the VM to this subnet, e.g. 192.168.77 (optional)
+    pub subnet: Option<String>,
+    /// Cloud-init datasource: nocloud or configdrive (optional)
+    pub metadata_source: Option<String>,
+    /// Login user for the default user-data instead of cirun (optional)
+    pub guest_user: Option<String>,
+    /// Password for the guest user; enables SSH password auth (optional)
+    pub guest_password: Option<String>,
+    /// Nameservers for the guest (default: the host's)
+    #[serde(default)]
+    pub dns_servers: Vec<String>,
+    /// DNS search domains for the guest
+    #[serde(default)]
+    pub dns_search: Vec<String>,
+    /// HTTP proxy for the guest (optional)
+    pub http_proxy: Option<String>,
+    /// HTTPS proxy for the guest (optional)
+    pub https_proxy: Option<String>,
+    /// Comma-separated hosts that bypass the guest proxy (optional)
+    pub no_proxy: Option<String>,
+    /// Guest timezone as a tz database name; also syncs the guest clock (optional)
+    pub timezone: Option<String>,
+    /// GitHub users whose public SSH keys are also authorised in the guest
+    #[serde(default)]
+    pub authorized_keys_from_github: Vec<String>,
+    /// Guest hostname instead of the VM name (optional)
+    pub hostname: Option<String>,
 }
 
 /// Generic API error response
@@ -226,6 +366,7 @@ impl From<crate::vm::VmInfo> for VmInfo {
             disk: vm_info.disk,
             devices: vm_info.devices,
             created: vm_info.created,
+            notes: vm_info.notes,
         }
     }
 }
@@ -97,6 +97,15 @@ impl FileChunker {
         Ok(size >= self.config.min_chunk_threshold)
     }
 
+    /// How many registry layers a file of `file_size` bytes is pushed as.
+    pub fn layer_count(&self, file_size: u64) -> usize {
+        if file_size >= self.config.min_chunk_threshold {
+            file_size.div_ceil(self.get_chunk_size(file_size)) as usize
+        } else {
+            1
+        }
+    }
+
     /// Determine the appropriate chunk size for a file
     fn get_chunk_size(&self, file_size: u64) -> u64 {
         if file_size >= self.config.large_file_threshold {
@@ -400,6 +409,21 @@ mod tests {
         assert_eq!(config.oras_concurrency, 10); // Base unchanged
     }
 
+    #[test]
+    fn test_layer_count() {
+        let chunker = FileChunker::new();
+        const MB: u64 = 1024 * 1024;
+        assert_eq!(chunker.layer_count(50 * MB), 1);
+        assert_eq!(chunker.layer_count(250 * MB), 3);
+        assert_eq!(chunker.layer_count(3 * 1024 * MB), 13);
+
+        let squashed = FileChunker::with_config(ChunkingConfig {
+            min_chunk_threshold: u64::MAX,
+            ..Default::default()
+        });
+        assert_eq!(squashed.layer_count(3 * 1024 * MB), 1);
+    }
+
     #[test]
     fn test_should_chunk_file() {
         let temp_dir = TempDir::new().unwrap();
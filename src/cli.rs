@@ -21,6 +21,12 @@ pub enum Commands {
         /// Path to user-data file (optional)
         user_data: Option<String>,
 
+        /// User-data part as TYPE:PATH (repeatable; cloud-config, shellscript,
+        /// boothook, include, jinja2, part-handler), assembled into one
+        /// multipart user-data in the order given
+        #[arg(long = "user-data-part", conflicts_with = "user_data")]
+        user_data_parts: Vec<String>,
+
         /// Force create (delete if exists)
         #[arg(short, long)]
         force: bool,
@@ -40,6 +46,93 @@ pub enum Commands {
         /// VFIO device path for PCI passthrough (repeatable, e.g., /sys/bus/pci/devices/0000:01:00.0)
         #[arg(long)]
         device: Vec<String>,
+
+        /// Guest memory backing: default, hugepages or shared
+        #[arg(long)]
+        memory_backing: Option<String>,
+
+        /// Guest swap file size (e.g., 2G), set up via the default user-data
+        #[arg(long)]
+        swap: Option<String>,
+
+        /// Host-side CPU cap for the VM process, in percent of a core (e.g., 200%)
+        #[arg(long)]
+        cpu_quota: Option<String>,
+
+        /// Host-side memory cap for the VM process (e.g., 6G)
+        #[arg(long)]
+        memory_limit: Option<String>,
+
+        /// Pin the VM process to these host CPUs (cpuset list, e.g., 0-3,8)
+        #[arg(long)]
+        cpuset: Option<String>,
+
+        /// Keep guest RAM (and, without --cpuset, vCPUs) on this host NUMA node
+        #[arg(long)]
+        numa_node: Option<u32>,
+
+        /// Attach a TPM 2.0 emulated by swtpm
+        #[arg(long)]
+        tpm: bool,
+
+        /// Pin the VM to this subnet (e.g., 192.168.77) instead of a random free one
+        #[arg(long)]
+        subnet: Option<String>,
+
+        /// Cloud-init datasource for the seed drive: nocloud or configdrive
+        #[arg(long)]
+        metadata_source: Option<String>,
+
+        /// Login user for the default user-data instead of cirun
+        #[arg(long)]
+        guest_user: Option<String>,
+
+        /// Password for the guest user; enables SSH password auth
+        #[arg(long)]
+        guest_password: Option<String>,
+
+        /// Nameserver for the guest (repeatable; default: the host's)
+        #[arg(long = "dns-server")]
+        dns_servers: Vec<String>,
+
+        /// DNS search domain for the guest (repeatable)
+        #[arg(long)]
+        dns_search: Vec<String>,
+
+        /// HTTP proxy for the guest (apt, /etc/environment)
+        #[arg(long)]
+        http_proxy: Option<String>,
+
+        /// HTTPS proxy for the guest
+        #[arg(long)]
+        https_proxy: Option<String>,
+
+        /// Comma-separated hosts that bypass the guest proxy
+        #[arg(long)]
+        no_proxy: Option<String>,
+
+        /// Guest timezone (tz database name, e.g. Europe/Berlin); the guest
+        /// also syncs its clock over NTP before SSH comes up
+        #[arg(long)]
+        timezone: Option<String>,
+
+        /// Also authorise the public SSH keys of this GitHub user
+        /// (repeatable; fetched from github.com/<user>.keys)
+        #[arg(long = "authorized-keys-from-github")]
+        authorized_keys_github: Vec<String>,
+
+        /// Also authorise the public keys loaded in your ssh-agent
+        #[arg(long = "authorized-keys-from-agent")]
+        authorized_keys_agent: bool,
+
+        /// Guest hostname instead of the VM name (RFC 1123)
+        #[arg(long)]
+        hostname: Option<String>,
+
+        /// Free-form note shown by `meda list`, e.g. which build created
+        /// the VM
+        #[arg(long)]
+        notes: Option<String>,
     },
 
     /// List all VMs
@@ -55,6 +148,33 @@ pub enum Commands {
     Ip {
         /// Name of the VM
         name: String,
+
+        /// Which address to report: auto, netns, guest, forward or static
+        #[arg(long, default_value = "auto")]
+        source: String,
+
+        /// Only report an address inside this subnet (e.g. 10.0.0.0/8)
+        #[arg(long)]
+        subnet: Option<String>,
+    },
+
+    /// Set a VM's note (shown by `meda list`); an empty note clears it
+    Notes {
+        /// Name of the VM
+        name: String,
+
+        /// The note
+        notes: String,
+    },
+
+    /// Show a VM's boot log (serial console and cloud-hypervisor output)
+    Logs {
+        /// Name of the VM
+        name: String,
+
+        /// Only show the last N lines
+        #[arg(long)]
+        tail: Option<usize>,
     },
 
     /// Start a VM
@@ -113,14 +233,125 @@ pub enum Commands {
         #[arg(long)]
         registry: Option<String>,
 
+        /// Extra tag to point at the pushed image, e.g. latest (repeatable)
+        #[arg(long = "also-tag", value_name = "TAG")]
+        also_tags: Vec<String>,
+
+        /// Manifest annotation as key=value (repeatable), e.g.
+        /// org.opencontainers.image.revision=$GIT_SHA. created, title and
+        /// the base image are filled in automatically
+        #[arg(long = "annotation", value_name = "KEY=VALUE")]
+        annotations: Vec<String>,
+
+        /// Upload each artifact as one layer instead of splitting large
+        /// disks into chunks (fewer layers; pulls can't fetch in parallel)
+        #[arg(long)]
+        squash: bool,
+
+        /// Delete the local image once the registry serves the pushed
+        /// reference (kept if a local VM or delta image still uses it)
+        #[arg(long)]
+        remove_local: bool,
+
+        /// Also tag the pushed image after its manifest digest
+        /// (sha256-<hex>) and record that reference in the local manifest
+        #[arg(long)]
+        tag_by_digest: bool,
+
+        /// If the extra tags fail, undo the push: tags it moved point back
+        /// at their previous image and the pushed manifest is deleted unless
+        /// another tag uses it (best effort; reports what is left)
+        #[arg(long, requires = "also_tags")]
+        rollback_on_failure: bool,
+
         /// Dry run - don't actually push
         #[arg(long)]
         dry_run: bool,
     },
 
+    /// Check that the registry accepts GITHUB_TOKEN for a push target,
+    /// without pushing; run before a long build to fail fast
+    CheckPush {
+        /// Target image name with tag (e.g., my-registry/my-image:v1.0)
+        image: String,
+
+        /// Registry URL (default: ghcr.io)
+        #[arg(long)]
+        registry: Option<String>,
+    },
+
+    /// Copy an image from one registry to another without rebuilding
+    /// (tokens: MEDA_SOURCE_TOKEN / MEDA_TARGET_TOKEN, else GITHUB_TOKEN)
+    Promote {
+        /// Source reference (e.g., ghcr.io/myorg-staging/my-image:v1.0)
+        source: String,
+
+        /// Target reference (e.g., ghcr.io/myorg/my-image:v1.0)
+        target: String,
+
+        /// Only resolve the source digest; don't copy
+        #[arg(long)]
+        dry_run: bool,
+    },
+
     /// List cached images
     Images,
 
+    /// Show where a local image's files are and its manifest metadata
+    Inspect {
+        /// Image name and tag (e.g., ubuntu:latest)
+        image: String,
+
+        /// Registry URL (default: ghcr.io)
+        #[arg(long)]
+        registry: Option<String>,
+
+        /// Organization/namespace (default: cirunlabs)
+        #[arg(long)]
+        org: Option<String>,
+    },
+
+    /// Merge a delta image and its backing chain into a new standalone image
+    Flatten {
+        /// Delta image name and tag (e.g., my-image:v2)
+        image: String,
+
+        /// Name and tag for the standalone copy (e.g., my-image:v2-full)
+        target: String,
+
+        /// Registry URL (default: ghcr.io)
+        #[arg(long)]
+        registry: Option<String>,
+
+        /// Organization/namespace (default: cirunlabs)
+        #[arg(long)]
+        org: Option<String>,
+    },
+
+    /// Write SLSA provenance for a local image (pushed with it); --sign
+    /// uses cosign with COSIGN_KEY when available
+    Provenance {
+        /// Image name and tag (e.g., my-image:v1.0)
+        image: String,
+
+        /// Registry URL (default: ghcr.io)
+        #[arg(long)]
+        registry: Option<String>,
+
+        /// Organization/namespace (default: cirunlabs)
+        #[arg(long)]
+        org: Option<String>,
+
+        /// Write the statement to this file instead of attaching it to the
+        /// image (the signature goes to <OUTPUT>.sig)
+        #[arg(long)]
+        output: Option<String>,
+
+        /// Sign the statement with cosign (skipped with a warning if unavailable)
+        #[arg(long)]
+        sign: bool,
+    },
+
     /// Remove a specific image
     Rmi {
         /// Image name and tag (e.g., ubuntu:latest, ubuntu)
@@ -145,6 +376,18 @@ pub enum Commands {
         #[arg(long)]
         all: bool,
 
+        /// Keep only the newest N tags of each image name
+        #[arg(long, conflicts_with = "all")]
+        keep_last: Option<usize>,
+
+        /// Only remove images created longer ago than this (e.g. 12h, 7d, 2w)
+        #[arg(long, conflicts_with = "all")]
+        older_than: Option<String>,
+
+        /// Only consider images whose name starts with this prefix
+        #[arg(long)]
+        name_prefix: Option<String>,
+
         /// Don't prompt for confirmation
         #[arg(short, long)]
         force: bool,
@@ -170,6 +413,98 @@ pub enum Commands {
         /// Create from existing VM instead of base image
         #[arg(long)]
         from_vm: Option<String>,
+
+        /// Skip the build and keep the existing image if the target
+        /// name:tag is already present locally (with --from-vm)
+        #[arg(long, requires = "from_vm")]
+        skip_if_exists: bool,
+
+        /// Hash of the build inputs, recorded in the image manifest and
+        /// pushed as an annotation; with --skip-if-exists an existing
+        /// image only counts as a cache hit if built from the same hash
+        #[arg(long, requires = "from_vm")]
+        inputs_hash: Option<String>,
+
+        /// Allow the target to be the image the VM was created from
+        /// (replaces the base other VMs from that image are backed by)
+        #[arg(long, requires = "from_vm")]
+        allow_base_overwrite: bool,
+
+        /// Reclaim free space in the running VM before imaging to shrink
+        /// the image: trim (fstrim) or zero (zero-fill)
+        #[arg(long, requires = "from_vm")]
+        zero_free_space: Option<String>,
+
+        /// Seal the running VM before imaging (reset machine-id, remove
+        /// SSH host keys, clean cloud-init and logs); fails if sealing fails
+        #[arg(long, requires = "from_vm")]
+        seal: bool,
+
+        /// Custom seal command run in the guest instead of the defaults
+        /// (repeatable, implies --seal)
+        #[arg(long, requires = "from_vm")]
+        seal_command: Vec<String>,
+
+        /// Pin the image to $SOURCE_DATE_EPOCH: clamp guest file mtimes
+        /// and use it as the image creation time
+        #[arg(long, requires = "from_vm")]
+        reproducible: bool,
+
+        /// Fail instead of saving the image if it takes more than this
+        /// much disk (e.g. 8G)
+        #[arg(long, requires = "from_vm")]
+        max_size: Option<String>,
+
+        /// Store only the VM's changes as a qcow2 delta on top of the image
+        /// it was run from (flattened again on push)
+        #[arg(long, requires = "from_vm")]
+        delta: bool,
+
+        /// Guest OS family to record (debian, rhel, suse, alpine, arch)
+        /// instead of detecting it from the running VM's /etc/os-release
+        #[arg(long, requires = "from_vm")]
+        guest_os: Option<String>,
+
+        /// Record the CI run this image was built in (provider, run id,
+        /// commit, actor, repository) from GitHub Actions, GitLab CI,
+        /// Buildkite, CircleCI or Jenkins environment variables
+        #[arg(long, requires = "from_vm")]
+        capture_ci_env: bool,
+    },
+
+    /// Export a local image as a (compressed) tarball
+    Export {
+        /// Image name and tag (e.g., ubuntu:latest)
+        image: String,
+
+        /// Output file (e.g., ubuntu-latest.tar.gz)
+        output: String,
+
+        /// Registry URL (default: ghcr.io)
+        #[arg(long)]
+        registry: Option<String>,
+
+        /// Organization/namespace (default: cirunlabs)
+        #[arg(long)]
+        org: Option<String>,
+
+        /// Compression: none, gzip (default) or zstd. Independent of
+        /// push, which always uploads uncompressed
+        #[arg(long)]
+        compression: Option<String>,
+
+        /// Output format: tar (the image directory), vagrant (a .box), raw
+        /// (the bare disk; output may be a block device) or qcow2
+        #[arg(long, default_value = "tar")]
+        format: String,
+
+        /// Vagrant provider for --format vagrant: libvirt or qemu
+        #[arg(long)]
+        provider: Option<String>,
+
+        /// With --format raw, allow writing over a block device
+        #[arg(long)]
+        allow_overwrite_device: bool,
     },
 
     /// Run a VM from an image — classic cold-boot path (~27s). Use
@@ -199,6 +534,11 @@ pub enum Commands {
         #[arg(long)]
         user_data: Option<String>,
 
+        /// User-data part as TYPE:PATH (repeatable), assembled into one
+        /// multipart user-data in the order given
+        #[arg(long = "user-data-part", conflicts_with = "user_data")]
+        user_data_parts: Vec<String>,
+
         /// Don't start the VM, just create it
         #[arg(long)]
         no_start: bool,
@@ -219,6 +559,104 @@ pub enum Commands {
         #[arg(long)]
         device: Vec<String>,
 
+        /// Guest memory backing: default, hugepages or shared (cold boot
+        /// only; implies --cold)
+        #[arg(long)]
+        memory_backing: Option<String>,
+
+        /// Guest swap file size (e.g., 2G), set up via the default user-data
+        /// (cold boot only; implies --cold)
+        #[arg(long)]
+        swap: Option<String>,
+
+        /// Host-side CPU cap for the VM process, in percent of a core (e.g.,
+        /// 200%; cold boot only; implies --cold)
+        #[arg(long)]
+        cpu_quota: Option<String>,
+
+        /// Host-side memory cap for the VM process (e.g., 6G; cold boot only;
+        /// implies --cold)
+        #[arg(long)]
+        memory_limit: Option<String>,
+
+        /// Pin the VM process to these host CPUs (cpuset list, e.g., 0-3,8;
+        /// cold boot only; implies --cold)
+        #[arg(long)]
+        cpuset: Option<String>,
+
+        /// Keep guest RAM (and, without --cpuset, vCPUs) on this host NUMA
+        /// node (cold boot only; implies --cold)
+        #[arg(long)]
+        numa_node: Option<u32>,
+
+        /// Attach a TPM 2.0 emulated by swtpm (cold boot only; implies --cold)
+        #[arg(long)]
+        tpm: bool,
+
+        /// Pin the VM to this subnet (e.g., 192.168.77) instead of a random
+        /// free one (cold boot only; implies --cold)
+        #[arg(long)]
+        subnet: Option<String>,
+
+        /// Cloud-init datasource for the seed drive: nocloud or configdrive
+        /// (configdrive is cold boot only; implies --cold)
+        #[arg(long)]
+        metadata_source: Option<String>,
+
+        /// Login user for the default user-data instead of cirun
+        /// (cold boot only; implies --cold)
+        #[arg(long)]
+        guest_user: Option<String>,
+
+        /// Password for the guest user; enables SSH password auth
+        /// (cold boot only; implies --cold)
+        #[arg(long)]
+        guest_password: Option<String>,
+
+        /// Nameserver for the guest (repeatable; default: the host's;
+        /// cold boot only; implies --cold)
+        #[arg(long = "dns-server")]
+        dns_servers: Vec<String>,
+
+        /// DNS search domain for the guest (repeatable; cold boot only;
+        /// implies --cold)
+        #[arg(long)]
+        dns_search: Vec<String>,
+
+        /// HTTP proxy for the guest (apt, /etc/environment; cold boot
+        /// only; implies --cold)
+        #[arg(long)]
+        http_proxy: Option<String>,
+
+        /// HTTPS proxy for the guest (cold boot only; implies --cold)
+        #[arg(long)]
+        https_proxy: Option<String>,
+
+        /// Comma-separated hosts that bypass the guest proxy (cold boot only;
+        /// implies --cold)
+        #[arg(long)]
+        no_proxy: Option<String>,
+
+        /// Guest timezone (tz database name), with an NTP clock sync
+        /// before SSH comes up (cold boot only; implies --cold)
+        #[arg(long)]
+        timezone: Option<String>,
+
+        /// Also authorise the public SSH keys of this GitHub user
+        /// (repeatable; cold boot only; implies --cold)
+        #[arg(long = "authorized-keys-from-github")]
+        authorized_keys_github: Vec<String>,
+
+        /// Also authorise the public keys loaded in your ssh-agent
+        /// (cold boot only; implies --cold)
+        #[arg(long = "authorized-keys-from-agent")]
+        authorized_keys_agent: bool,
+
+        /// Guest hostname instead of the VM name (cold boot only; implies
+        /// --cold)
+        #[arg(long)]
+        hostname: Option<String>,
+
         /// Skip the auto-template fast path and cold-boot as before.
         #[arg(long)]
         cold: bool,
@@ -226,8 +664,18 @@ pub enum Commands {
         /// After the VM is ready, exec into it with ssh. The VM
         /// keeps running after you exit the shell; clean it up
         /// with `meda delete <vm_name>`.
-        #[arg(long)]
+        #[arg(long, conflicts_with = "no_start")]
         ssh: bool,
+
+        /// With --ssh: verify the VM host key against this known_hosts
+        /// file and refuse to connect on mismatch
+        #[arg(long, requires = "ssh")]
+        known_hosts: Option<String>,
+
+        /// With --ssh: pin the VM host key on first connect (stored in
+        /// the VM dir) and refuse to connect if it later changes
+        #[arg(long, requires = "ssh")]
+        strict_host_key: bool,
     },
 
     /// Clean up orphaned TAP devices
@@ -270,5 +718,9 @@ pub enum Commands {
         /// Host to bind to (default: 127.0.0.1)
         #[arg(long, default_value = "127.0.0.1")]
         host: String,
+
+        /// Listen on this unix socket path instead of host:port
+        #[arg(long, conflicts_with_all = ["port", "host"])]
+        socket: Option<String>,
     },
 }
@@ -0,0 +1,981 @@
+//! Cloud-init seed for a VM: the `ci/` staging dir and the `ci.iso`
+//! built from it. Shared by `meda create` and the cold `meda run` path
+//! so both hand the guest the same metadata.
+//!
+//! Two datasource layouts are supported:
+//!
+//! - NoCloud (default): `meta-data`, `user-data`, `network-config` at
+//!   the ISO root, volume label `cidata`. What Ubuntu cloud images and
+//!   most others look for first.
+//! - ConfigDrive: the OpenStack layout under `openstack/latest/`
+//!   (`meta_data.json`, `user_data`, `network_data.json`), volume label
+//!   `config-2`. For images whose cloud-init is restricted to the
+//!   OpenStack datasource.
+//!
+//! Nameservers come from `--dns-server`/`--dns-search` when given,
+//! otherwise from the host's resolver config (loopback stubs such as
+//! systemd-resolved's 127.0.0.53 are skipped since the guest can't
+//! reach them), and finally from public resolvers.
+//!
+//! The seed ISO never ends up in an image: `create-image` only converts
+//! the rootfs, so there is nothing to detach before imaging.
+
+use crate::error::{Error, Result};
+use crate::util::write_string_to_file;
+use std::fs;
+use std::net::IpAddr;
+use std::path::Path;
+
+/// How user-data and metadata are delivered to the guest.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum MetadataSource {
+    #[default]
+    NoCloud,
+    ConfigDrive,
+}
+
+impl MetadataSource {
+    pub fn parse(value: &str) -> Result<Self> {
+        match value.to_ascii_lowercase().as_str() {
+            "nocloud" => Ok(Self::NoCloud),
+            "configdrive" | "config-drive" => Ok(Self::ConfigDrive),
+            other => Err(Error::Other(format!(
+                "Unknown metadata source '{}' (expected nocloud or configdrive)",
+                other
+            ))),
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::NoCloud => "nocloud",
+            Self::ConfigDrive => "configdrive",
+        }
+    }
+
+    fn volume_label(&self) -> &'static str {
+        match self {
+            Self::NoCloud => "cidata",
+            Self::ConfigDrive => "config-2",
+        }
+    }
+}
+
+/// Login user of the default user-data when none is configured.
+pub const DEFAULT_GUEST_USER: &str = "cirun";
+
+/// Used when neither the caller nor the host supplies a nameserver the
+/// guest can reach.
+const FALLBACK_NAMESERVERS: [&str; 2] = ["8.8.8.8", "1.1.1.1"];
+
+/// Host resolver configs, in order of preference. systemd-resolved's
+/// upstream list comes first because `/etc/resolv.conf` then only
+/// names its loopback stub.
+const HOST_RESOLV_CONFS: [&str; 2] = ["/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"];
+
+/// The host's copy of the tz database, used to check `--timezone`.
+const ZONEINFO_DIR: &str = "/usr/share/zoneinfo";
+
+/// How long the guest waits on first boot for NTP before carrying on
+/// with a possibly wrong clock.
+const CLOCK_SYNC_TIMEOUT_SECS: u32 = 30;
+
+/// Key types accepted in `authorized_keys` entries.
+const SSH_KEY_TYPES: [&str; 7] = [
+    "ssh-ed25519",
+    "ssh-rsa",
+    "ecdsa-sha2-nistp256",
+    "ecdsa-sha2-nistp384",
+    "ecdsa-sha2-nistp521",
+    "sk-ssh-ed25519@openssh.com",
+    "sk-ecdsa-sha2-nistp256@openssh.com",
+];
+
+/// Guest-side cloud-init settings chosen at create/run time.
+#[derive(Clone, Debug, Default)]
+pub struct CloudInitOptions {
+    pub metadata_source: MetadataSource,
+    /// Login user for the default user-data instead of `cirun`.
+    pub guest_user: Option<String>,
+    /// Plain-text password for the guest user. Setting it is the only
+    /// way to turn on SSH password auth for a configured user.
+    pub guest_password: Option<String>,
+    /// Nameservers for the guest instead of the host's.
+    pub dns_servers: Vec<String>,
+    /// Search domains for the guest.
+    pub dns_search: Vec<String>,
+    /// Proxy for in-guest HTTP traffic (apt and anything that reads
+    /// `http_proxy`).
+    pub http_proxy: Option<String>,
+    pub https_proxy: Option<String>,
+    /// Comma-separated hosts/domains that bypass the proxy.
+    pub no_proxy: Option<String>,
+    /// tz database name for the guest (e.g. `Europe/Berlin`). Also
+    /// makes the guest sync its clock before SSH comes up.
+    pub timezone: Option<String>,
+    /// Extra public keys authorised for the guest user alongside
+    /// meda's own, one `authorized_keys` line each.
+    pub authorized_keys: Vec<String>,
+    /// Guest hostname instead of the VM name.
+    pub hostname: Option<String>,
+}
+
+impl CloudInitOptions {
+    /// Apply an optional `--metadata-source` value, validating it.
+    pub fn with_metadata_source(mut self, metadata_source: Option<&str>) -> Result<Self> {
+        if let Some(source) = metadata_source {
+            self.metadata_source = MetadataSource::parse(source)?;
+        }
+        Ok(self)
+    }
+
+    /// Apply optional `--guest-user` / `--guest-password` values.
+    pub fn with_credentials(mut self, user: Option<&str>, password: Option<&str>) -> Result<Self> {
+        if let Some(user) = user {
+            let mut chars = user.chars();
+            let valid = user.len() <= 32
+                && chars
+                    .next()
+                    .is_some_and(|c| c.is_ascii_lowercase() || c == '_')
+                && chars
+                    .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '_' || c == '-');
+            if !valid {
+                return Err(Error::Other(format!(
+                    "Invalid guest user '{}' (expected a lowercase Linux user name)",
+                    user
+                )));
+            }
+            self.guest_user = Some(user.to_string());
+        }
+        if let Some(password) = password {
+            if password.is_empty() {
+                return Err(Error::Other("Guest password must not be empty".to_string()));
+            }
+            log::warn!(
+                "guest password set: SSH password authentication will be enabled in the VM; \
+                 prefer key-based access outside of demos"
+            );
+            self.guest_password = Some(password.to_string());
+        }
+        Ok(self)
+    }
+
+    /// Apply `--dns-server` / `--dns-search` values, validating them.
+    pub fn with_dns(mut self, servers: &[String], search: &[String]) -> Result<Self> {
+        for server in servers {
+            if server.parse::<IpAddr>().is_err() {
+                return Err(Error::Other(format!(
+                    "Invalid DNS server '{}' (expected an IP address)",
+                    server
+                )));
+            }
+        }
+        for domain in search {
+            let valid = !domain.is_empty()
+                && domain.len() <= 253
+                && domain.split('.').all(|label| {
+                    !label.is_empty()
+                        && label.len() <= 63
+                        && !label.starts_with('-')
+                        && !label.ends_with('-')
+                        && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+                });
+            if !valid {
+                return Err(Error::Other(format!(
+                    "Invalid DNS search domain '{}'",
+                    domain
+                )));
+            }
+        }
+        self.dns_servers = servers.to_vec();
+        self.dns_search = search.to_vec();
+        Ok(self)
+    }
+
+    /// Apply `--http-proxy` / `--https-proxy` / `--no-proxy` values,
+    /// checking the proxies are http(s) URLs with a host.
+    pub fn with_proxy(
+        mut self,
+        http_proxy: Option<&str>,
+        https_proxy: Option<&str>,
+        no_proxy: Option<&str>,
+    ) -> Result<Self> {
+        for proxy in [http_proxy, https_proxy].into_iter().flatten() {
+            let valid = reqwest::Url::parse(proxy).is_ok_and(|url| {
+                matches!(url.scheme(), "http" | "https") && url.host_str().is_some()
+            });
+            if !valid {
+                return Err(Error::Other(format!(
+                    "Invalid proxy URL '{}' (expected e.g. http://proxy.example:3128)",
+                    proxy
+                )));
+            }
+        }
+        if let Some(no_proxy) = no_proxy {
+            if no_proxy.chars().any(|c| c.is_whitespace() || c == '"') {
+                return Err(Error::Other(format!(
+                    "Invalid no-proxy list '{}' (expected comma-separated hosts)",
+                    no_proxy
+                )));
+            }
+        }
+        self.http_proxy = http_proxy.map(str::to_string);
+        self.https_proxy = https_proxy.map(str::to_string);
+        self.no_proxy = no_proxy.map(str::to_string);
+        Ok(self)
+    }
+
+    /// Apply an optional `--timezone`, checking it against the host's
+    /// tz database when there is one.
+    pub fn with_timezone(mut self, timezone: Option<&str>) -> Result<Self> {
+        if let Some(timezone) = timezone {
+            if !valid_timezone(timezone, Path::new(ZONEINFO_DIR)) {
+                return Err(Error::Other(format!(
+                    "Unknown timezone '{}' (expected a tz database name such as Europe/Berlin or UTC)",
+                    timezone
+                )));
+            }
+            self.timezone = Some(timezone.to_string());
+        }
+        Ok(self)
+    }
+
+    /// Apply extra public keys (from `--authorized-keys-from-github` /
+    /// `--authorized-keys-from-agent`), rejecting anything that isn't a
+    /// well-formed public key line. Duplicates are dropped.
+    pub fn with_authorized_keys(mut self, keys: Vec<String>) -> Result<Self> {
+        for key in keys {
+            if !valid_public_key(&key) {
+                return Err(Error::Other(format!("Invalid SSH public key '{}'", key)));
+            }
+            if !self.authorized_keys.contains(&key) {
+                self.authorized_keys.push(key);
+            }
+        }
+        Ok(self)
+    }
+
+    /// Apply an optional `--hostname`, checking it is a valid RFC 1123
+    /// host name.
+    pub fn with_hostname(mut self, hostname: Option<&str>) -> Result<Self> {
+        if let Some(hostname) = hostname {
+            let valid = hostname.len() <= 253
+                && hostname.split('.').all(|label| {
+                    !label.is_empty()
+                        && label.len() <= 63
+                        && !label.starts_with('-')
+                        && !label.ends_with('-')
+                        && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+                });
+            if !valid {
+                return Err(Error::Other(format!(
+                    "Invalid hostname '{}' (expected letters, digits and hyphens, e.g. builder-01)",
+                    hostname
+                )));
+            }
+            self.hostname = Some(hostname.to_string());
+        }
+        Ok(self)
+    }
+
+    /// The hostname the guest gets: `--hostname`, else the VM name.
+    pub(crate) fn hostname<'a>(&'a self, vm_name: &'a str) -> &'a str {
+        self.hostname.as_deref().unwrap_or(vm_name)
+    }
+
+    /// cloud-config setting the timezone and syncing the clock. The
+    /// wait runs in bootcmd, which cloud-init finishes before sshd
+    /// starts, so provisioning over SSH never sees a skewed clock (TLS
+    /// "not yet valid", apt "Release file is not valid yet").
+    /// `cloud-init-per instance` keeps it to the first boot, and it
+    /// gives up after [`CLOCK_SYNC_TIMEOUT_SECS`] so a guest without NTP
+    /// access still comes up. Empty without a timezone.
+    pub(crate) fn time_user_data(&self) -> String {
+        let Some(timezone) = &self.timezone else {
+            return String::new();
+        };
+        let wait = format!(
+            "timedatectl set-ntp true; for i in $(seq {}); do \
+             [ \"$(timedatectl show -p NTPSynchronized --value)\" = yes ] && break; sleep 1; done",
+            CLOCK_SYNC_TIMEOUT_SECS
+        );
+        format!(
+            "timezone: {}\nntp:\n  enabled: true\n\
+             bootcmd:\n  - [cloud-init-per, instance, meda-clock-sync, sh, -c, {}]\n",
+            timezone,
+            serde_json::Value::String(wait)
+        )
+    }
+
+    fn has_proxy(&self) -> bool {
+        self.http_proxy.is_some() || self.https_proxy.is_some()
+    }
+
+    /// cloud-config sections routing the guest through the configured
+    /// proxy: apt's own setting, plus the usual variables (both cases)
+    /// in /etc/environment for login shells, sudo and yum/dnf. Empty
+    /// without a proxy.
+    pub(crate) fn proxy_user_data(&self) -> String {
+        if !self.has_proxy() {
+            return String::new();
+        }
+        // JSON strings are valid double-quoted YAML scalars.
+        let quote = |value: &str| serde_json::Value::String(value.to_string()).to_string();
+        let mut apt = String::from("apt:\n");
+        let mut environment = String::new();
+        for (name, value) in [
+            ("http_proxy", &self.http_proxy),
+            ("https_proxy", &self.https_proxy),
+            ("no_proxy", &self.no_proxy),
+        ] {
+            let Some(value) = value else { continue };
+            if name != "no_proxy" {
+                apt.push_str(&format!("  {}: {}\n", name, quote(value)));
+            }
+            environment.push_str(&format!(
+                "{}=\"{}\"\n{}=\"{}\"\n",
+                name,
+                value,
+                name.to_ascii_uppercase(),
+                value
+            ));
+        }
+        format!(
+            "{}write_files:\n  - path: /etc/environment\n    append: true\n    content: {}\n",
+            apt,
+            quote(&environment)
+        )
+    }
+
+    pub fn has_credentials(&self) -> bool {
+        self.guest_user.is_some() || self.guest_password.is_some()
+    }
+
+    /// Whether the VM needs a seed built for it, as opposed to booting
+    /// from a template that already carries its own.
+    pub fn needs_cold_boot(&self) -> bool {
+        self.metadata_source != MetadataSource::default()
+            || self.has_credentials()
+            || self.has_proxy()
+            || !self.dns_servers.is_empty()
+            || !self.dns_search.is_empty()
+            || self.timezone.is_some()
+            || !self.authorized_keys.is_empty()
+            || self.hostname.is_some()
+    }
+
+    /// Nameservers and search domains to hand the guest: the configured
+    /// ones, else the host's, else [`FALLBACK_NAMESERVERS`].
+    fn guest_dns(&self) -> (Vec<String>, Vec<String>) {
+        if !self.dns_servers.is_empty() {
+            return (self.dns_servers.clone(), self.dns_search.clone());
+        }
+        let (mut servers, host_search) = HOST_RESOLV_CONFS
+            .iter()
+            .filter_map(|path| fs::read_to_string(path).ok())
+            .map(|body| parse_resolv_conf(&body))
+            .find(|(servers, _)| !servers.is_empty())
+            .unwrap_or_default();
+        if servers.is_empty() {
+            servers = FALLBACK_NAMESERVERS.iter().map(|s| s.to_string()).collect();
+        }
+        let search = if self.dns_search.is_empty() {
+            host_search
+        } else {
+            self.dns_search.clone()
+        };
+        (servers, search)
+    }
+
+    /// The user meda logs in as over SSH.
+    pub fn guest_user(&self) -> &str {
+        self.guest_user.as_deref().unwrap_or(DEFAULT_GUEST_USER)
+    }
+}
+
+/// Whether `name` looks like a tz database name and, if the host has a
+/// `zoneinfo` tree, is in it. The shape check alone keeps the value
+/// safe to splice into user-data and the lookup inside `zoneinfo`.
+fn valid_timezone(name: &str, zoneinfo: &Path) -> bool {
+    let shaped = !name.is_empty()
+        && name.len() <= 64
+        && name.split('/').all(|part| {
+            !part.is_empty()
+                && !part.starts_with('.')
+                && part
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '+'))
+        });
+    if !shaped {
+        return false;
+    }
+    !zoneinfo.is_dir() || zoneinfo.join(name).is_file()
+}
+
+/// Nameservers and search domains from a resolv.conf, leaving out
+/// loopback addresses the guest has no route to.
+fn parse_resolv_conf(body: &str) -> (Vec<String>, Vec<String>) {
+    let mut servers = Vec::new();
+    let mut search = Vec::new();
+    for line in body.lines() {
+        let mut fields = line.split_whitespace();
+        match fields.next() {
+            Some("nameserver") => {
+                if let Some(Ok(addr)) = fields.next().map(str::parse::<IpAddr>) {
+                    if !addr.is_loopback() {
+                        servers.push(addr.to_string());
+                    }
+                }
+            }
+            // The last search/domain line wins, as in the resolver.
+            Some("search") | Some("domain") => {
+                search = fields.map(str::to_string).collect();
+            }
+            _ => {}
+        }
+    }
+    (servers, search)
+}
+
+/// netplan v2 network-config for the NoCloud datasource: static
+/// `<subnet>.2/24` on the NIC with `mac`, gateway `<subnet>.1`.
+pub fn network_config(mac: &str, subnet: &str, servers: &[String], search: &[String]) -> String {
+    let mut config = format!(
+        r#"version: 2
+ethernets:
+  ens4:
+    match:
+       macaddress: {}
+    addresses: [{}.2/24]
+    gateway4: {}.1
+    set-name: ens4
+    nameservers:
+      addresses: [{}]
+"#,
+        mac,
+        subnet,
+        subnet,
+        servers.join(", ")
+    );
+    if !search.is_empty() {
+        config.push_str(&format!("      search: [{}]\n", search.join(", ")));
+    }
+    config
+}
+
+/// The same network as [`network_config`] in OpenStack
+/// `network_data.json` form. That format has no search domains.
+fn network_data_json(mac: &str, subnet: &str, servers: &[String]) -> serde_json::Value {
+    serde_json::json!({
+        "links": [{
+            "id": "ens4",
+            "type": "phy",
+            "ethernet_mac_address": mac,
+        }],
+        "networks": [{
+            "id": "network0",
+            "type": "ipv4",
+            "link": "ens4",
+            "ip_address": format!("{}.2", subnet),
+            "netmask": "255.255.255.0",
+            "routes": [{
+                "network": "0.0.0.0",
+                "netmask": "0.0.0.0",
+                "gateway": format!("{}.1", subnet),
+            }],
+        }],
+        "services": servers
+            .iter()
+            .map(|address| serde_json::json!({"type": "dns", "address": address}))
+            .collect::<Vec<_>>(),
+    })
+}
+
+/// Part types `--user-data-part` accepts, by short name and MIME type.
+const USER_DATA_PART_TYPES: [(&str, &str); 6] = [
+    ("cloud-config", "text/cloud-config"),
+    ("shellscript", "text/x-shellscript"),
+    ("boothook", "text/cloud-boothook"),
+    ("include", "text/x-include-url"),
+    ("jinja2", "text/jinja2"),
+    ("part-handler", "text/part-handler"),
+];
+
+/// Separator between the parts of an assembled user-data. Parts that
+/// contain it are rejected rather than silently split.
+const USER_DATA_BOUNDARY: &str = "==MEDA_USER_DATA_BOUNDARY==";
+
+/// One `--user-data-part TYPE:PATH`, read and type-checked.
+#[derive(Debug)]
+struct UserDataPart {
+    content_type: &'static str,
+    filename: String,
+    content: String,
+}
+
+impl UserDataPart {
+    fn parse(spec: &str) -> Result<Self> {
+        let (kind, path) = spec.split_once(':').ok_or_else(|| {
+            Error::Other(format!(
+                "Invalid user-data part '{}' (expected TYPE:PATH, e.g. cloud-config:base.yaml)",
+                spec
+            ))
+        })?;
+        let content_type = USER_DATA_PART_TYPES
+            .iter()
+            .find(|(name, mime)| *name == kind || *mime == kind)
+            .map(|(_, mime)| *mime)
+            .ok_or_else(|| {
+                let names: Vec<&str> = USER_DATA_PART_TYPES.iter().map(|(n, _)| *n).collect();
+                Error::Other(format!(
+                    "Unknown user-data part type '{}' (expected one of: {})",
+                    kind,
+                    names.join(", ")
+                ))
+            })?;
+        let content = fs::read_to_string(path)
+            .map_err(|e| Error::Other(format!("Failed to read user-data part {}: {}", path, e)))?;
+        if content_type == "text/x-shellscript" && !content.starts_with("#!") {
+            return Err(Error::Other(format!(
+                "User-data part {} is a shellscript but has no #! line",
+                path
+            )));
+        }
+        if content.contains(USER_DATA_BOUNDARY) {
+            return Err(Error::Other(format!(
+                "User-data part {} contains the MIME boundary {}",
+                path, USER_DATA_BOUNDARY
+            )));
+        }
+        let filename = Path::new(path)
+            .file_name()
+            .map(|name| name.to_string_lossy().replace('"', ""))
+            .unwrap_or_else(|| "part".to_string());
+        Ok(Self {
+            content_type,
+            filename,
+            content,
+        })
+    }
+}
+
+/// A multipart/mixed user-data document with one part per entry, in
+/// order, which cloud-init splits and handles by type.
+fn multipart_user_data(parts: &[UserDataPart]) -> String {
+    let mut document = format!(
+        "Content-Type: multipart/mixed; boundary=\"{}\"\nMIME-Version: 1.0\n\n",
+        USER_DATA_BOUNDARY
+    );
+    for part in parts {
+        document.push_str(&format!(
+            "--{}\nContent-Type: {}; charset=\"utf-8\"\nMIME-Version: 1.0\n\
+             Content-Disposition: attachment; filename=\"{}\"\n\n{}",
+            USER_DATA_BOUNDARY, part.content_type, part.filename, part.content
+        ));
+        if !part.content.ends_with('\n') {
+            document.push('\n');
+        }
+    }
+    document.push_str(&format!("--{}--\n", USER_DATA_BOUNDARY));
+    document
+}
+
+/// Assemble `--user-data-part TYPE:PATH` specs into a user-data file
+/// for create/run to consume like `--user-data`. `None` without parts;
+/// the file is removed when the returned handle drops.
+pub fn user_data_parts_file(specs: &[String]) -> Result<Option<tempfile::NamedTempFile>> {
+    if specs.is_empty() {
+        return Ok(None);
+    }
+    let parts = specs
+        .iter()
+        .map(|spec| UserDataPart::parse(spec))
+        .collect::<Result<Vec<_>>>()?;
+    let file = tempfile::Builder::new()
+        .prefix("meda-user-data-")
+        .tempfile()?;
+    write_string_to_file(file.path(), &multipart_user_data(&parts))?;
+    Ok(Some(file))
+}
+
+/// Stage the seed files from `vm_dir/{meta-data,user-data}` into
+/// `vm_dir/ci` in the layout `options` asks for, then build
+/// `vm_dir/ci.iso` from it.
+pub fn build_seed_iso(
+    vm_dir: &Path,
+    vm_name: &str,
+    mac: &str,
+    subnet: &str,
+    options: &CloudInitOptions,
+) -> Result<()> {
+    let ci_dir = vm_dir.join("ci");
+    fs::create_dir_all(&ci_dir)?;
+    let (dns_servers, dns_search) = options.guest_dns();
+
+    match options.metadata_source {
+        MetadataSource::NoCloud => {
+            for file in ["meta-data", "user-data"] {
+                let src = vm_dir.join(file);
+                if src.exists() {
+                    fs::copy(&src, ci_dir.join(file))?;
+                }
+            }
+            write_string_to_file(
+                &ci_dir.join("network-config"),
+                &network_config(mac, subnet, &dns_servers, &dns_search),
+            )?;
+        }
+        MetadataSource::ConfigDrive => {
+            if !options.dns_search.is_empty() {
+                log::warn!("network_data.json has no search domains; ignoring --dns-search");
+            }
+            let latest = ci_dir.join("openstack").join("latest");
+            fs::create_dir_all(&latest)?;
+            let meta_data = serde_json::json!({
+                "uuid": vm_name,
+                "name": vm_name,
+                "hostname": options.hostname(vm_name),
+            });
+            write_string_to_file(
+                &latest.join("meta_data.json"),
+                &serde_json::to_string_pretty(&meta_data)?,
+            )?;
+            let user_data = vm_dir.join("user-data");
+            if user_data.exists() {
+                fs::copy(&user_data, latest.join("user_data"))?;
+            }
+            write_string_to_file(
+                &latest.join("network_data.json"),
+                &serde_json::to_string_pretty(&network_data_json(mac, subnet, &dns_servers))?,
+            )?;
+        }
+    }
+    write_string_to_file(
+        &vm_dir.join("metadata_source"),
+        options.metadata_source.as_str(),
+    )?;
+
+    let ci_iso = vm_dir.join("ci.iso");
+    crate::util::run_command_quietly(
+        "genisoimage",
+        &[
+            "-output",
+            ci_iso.to_str().unwrap(),
+            "-volid",
+            options.metadata_source.volume_label(),
+            "-joliet",
+            "-rock",
+            ci_dir.to_str().unwrap(),
+        ],
+    )
+}
+
+/// Whether `line` is an `authorized_keys` public key: a known type
+/// followed by a base64 blob that encodes that same type, then an
+/// optional comment.
+fn valid_public_key(line: &str) -> bool {
+    use base64::Engine;
+
+    if line.contains(['\n', '\r']) {
+        return false;
+    }
+    let mut fields = line.split_whitespace();
+    let (Some(key_type), Some(blob)) = (fields.next(), fields.next()) else {
+        return false;
+    };
+    if !SSH_KEY_TYPES.contains(&key_type) {
+        return false;
+    }
+    let Ok(blob) = base64::engine::general_purpose::STANDARD.decode(blob) else {
+        return false;
+    };
+    // The blob starts with the key type as a length-prefixed string.
+    let Some(len) = blob
+        .get(..4)
+        .map(|len| u32::from_be_bytes([len[0], len[1], len[2], len[3]]) as usize)
+    else {
+        return false;
+    };
+    blob.get(4..4 + len) == Some(key_type.as_bytes())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_metadata_source_parse() {
+        assert_eq!(
+            MetadataSource::parse("nocloud").unwrap(),
+            MetadataSource::NoCloud
+        );
+        assert_eq!(
+            MetadataSource::parse("ConfigDrive").unwrap(),
+            MetadataSource::ConfigDrive
+        );
+        assert!(MetadataSource::parse("ec2").is_err());
+        assert_eq!(MetadataSource::ConfigDrive.volume_label(), "config-2");
+        assert_eq!(MetadataSource::NoCloud.volume_label(), "cidata");
+
+        assert!(CloudInitOptions::default()
+            .with_metadata_source(Some("configdrive"))
+            .unwrap()
+            .needs_cold_boot());
+        assert!(!CloudInitOptions::default()
+            .with_metadata_source(Some("nocloud"))
+            .unwrap()
+            .needs_cold_boot());
+    }
+
+    #[test]
+    fn test_with_credentials_validates() {
+        let options = CloudInitOptions::default()
+            .with_credentials(Some("builder"), Some("s3cret"))
+            .unwrap();
+        assert_eq!(options.guest_user(), "builder");
+        assert_eq!(options.guest_password.as_deref(), Some("s3cret"));
+        assert_eq!(CloudInitOptions::default().guest_user(), "cirun");
+
+        assert!(CloudInitOptions::default()
+            .with_credentials(Some("Root"), None)
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_credentials(Some("a b"), None)
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_credentials(None, Some(""))
+            .is_err());
+    }
+
+    #[test]
+    fn test_with_dns_validates() {
+        let servers = vec!["10.0.0.53".to_string(), "fd00::53".to_string()];
+        let search = vec!["corp.example.com".to_string()];
+        let options = CloudInitOptions::default()
+            .with_dns(&servers, &search)
+            .unwrap();
+        assert!(options.needs_cold_boot());
+        assert_eq!(options.guest_dns(), (servers, search));
+        assert!(!CloudInitOptions::default().needs_cold_boot());
+
+        assert!(CloudInitOptions::default()
+            .with_dns(&["mirror.local".to_string()], &[])
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_dns(&[], &["bad domain".to_string()])
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_dns(&[], &["-corp.example".to_string()])
+            .is_err());
+    }
+
+    #[test]
+    fn test_with_proxy_validates() {
+        let options = CloudInitOptions::default()
+            .with_proxy(
+                Some("http://proxy.corp:3128"),
+                None,
+                Some("localhost,.corp"),
+            )
+            .unwrap();
+        assert!(options.needs_cold_boot());
+        let user_data = options.proxy_user_data();
+        assert!(user_data.starts_with("apt:\n  http_proxy: \"http://proxy.corp:3128\"\n"));
+        assert!(!user_data.contains("https_proxy"));
+        assert!(user_data.contains("path: /etc/environment"));
+        assert!(user_data.contains("append: true"));
+        assert!(user_data.contains(r#"HTTP_PROXY=\"http://proxy.corp:3128\""#));
+        assert!(user_data.contains(r#"no_proxy=\"localhost,.corp\""#));
+        assert_eq!(CloudInitOptions::default().proxy_user_data(), "");
+
+        assert!(CloudInitOptions::default()
+            .with_proxy(Some("proxy.corp:3128"), None, None)
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_proxy(None, Some("socks5://proxy.corp:1080"), None)
+            .is_err());
+        assert!(CloudInitOptions::default()
+            .with_proxy(None, None, Some("a, b"))
+            .is_err());
+    }
+
+    #[test]
+    fn test_valid_timezone() {
+        let temp_dir = TempDir::new().unwrap();
+        let zoneinfo = temp_dir.path();
+        fs::create_dir_all(zoneinfo.join("Europe")).unwrap();
+        fs::write(zoneinfo.join("Europe/Berlin"), "").unwrap();
+        fs::write(zoneinfo.join("UTC"), "").unwrap();
+        assert!(valid_timezone("Europe/Berlin", zoneinfo));
+        assert!(valid_timezone("UTC", zoneinfo));
+        assert!(!valid_timezone("Europe/Atlantis", zoneinfo));
+        assert!(!valid_timezone("Europe", zoneinfo));
+
+        // Without a zoneinfo tree only the shape is checked.
+        let missing = zoneinfo.join("missing");
+        assert!(valid_timezone("Etc/GMT+5", &missing));
+        assert!(!valid_timezone("../etc/passwd", &missing));
+        assert!(!valid_timezone("Europe/Berlin\nruncmd:", &missing));
+        assert!(!valid_timezone("", &missing));
+    }
+
+    #[test]
+    fn test_time_user_data() {
+        assert_eq!(CloudInitOptions::default().time_user_data(), "");
+        let options = CloudInitOptions {
+            timezone: Some("Europe/Berlin".to_string()),
+            ..Default::default()
+        };
+        assert!(options.needs_cold_boot());
+        let user_data = options.time_user_data();
+        assert!(user_data.starts_with("timezone: Europe/Berlin\nntp:\n  enabled: true\n"));
+        assert!(user_data.contains(
+            "bootcmd:\n  - [cloud-init-per, instance, meda-clock-sync, sh, -c, \"timedatectl set-ntp true;"
+        ));
+        assert!(user_data.contains("$(seq 30)"));
+        assert!(!user_data.contains("runcmd"));
+        assert!(user_data.contains("NTPSynchronized"));
+    }
+
+    #[test]
+    fn test_user_data_part_parse() {
+        let temp_dir = TempDir::new().unwrap();
+        let script = temp_dir.path().join("setup.sh");
+        fs::write(&script, "#!/bin/sh\necho hi\n").unwrap();
+        let not_script = temp_dir.path().join("plain.sh");
+        fs::write(&not_script, "echo hi\n").unwrap();
+
+        let part = UserDataPart::parse(&format!("shellscript:{}", script.display())).unwrap();
+        assert_eq!(part.content_type, "text/x-shellscript");
+        assert_eq!(part.filename, "setup.sh");
+        let part = UserDataPart::parse(&format!("text/cloud-boothook:{}", script.display()));
+        assert_eq!(part.unwrap().content_type, "text/cloud-boothook");
+
+        assert!(UserDataPart::parse(script.to_str().unwrap()).is_err());
+        assert!(UserDataPart::parse(&format!("text/html:{}", script.display())).is_err());
+        assert!(UserDataPart::parse(&format!("shellscript:{}", not_script.display())).is_err());
+        assert!(UserDataPart::parse("cloud-config:/nonexistent/base.yaml").is_err());
+    }
+
+    #[test]
+    fn test_with_hostname() {
+        let options = CloudInitOptions::default()
+            .with_hostname(Some("builder-01.ci.example"))
+            .unwrap();
+        assert_eq!(options.hostname("vm-123"), "builder-01.ci.example");
+        assert!(options.needs_cold_boot());
+        assert_eq!(CloudInitOptions::default().hostname("vm-123"), "vm-123");
+
+        let long_label = "x".repeat(64);
+        for bad in ["", "-builder", "build_er", "a..b", long_label.as_str()] {
+            assert!(
+                CloudInitOptions::default()
+                    .with_hostname(Some(bad))
+                    .is_err(),
+                "{}",
+                bad
+            );
+        }
+    }
+
+    #[test]
+    fn test_with_authorized_keys() {
+        let key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHw4qsecUqGtXKKSO4wYcWG0nzoz5J9e2oBhb+jqBokY meda@localhost";
+        let options = CloudInitOptions::default()
+            .with_authorized_keys(vec![key.to_string(), key.to_string()])
+            .unwrap();
+        assert_eq!(options.authorized_keys, vec![key.to_string()]);
+        assert!(options.needs_cold_boot());
+
+        // The blob must encode the key type it claims to be.
+        let mislabelled = key.replacen("ssh-ed25519", "ssh-rsa", 1);
+        for bad in [
+            "not a key",
+            "ssh-ed25519",
+            "ssh-ed25519 !!!",
+            mislabelled.as_str(),
+            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHw4qsecUqGtXKKSO4wYcWG0nzoz5J9e2oBhb+jqBokY\nx",
+        ] {
+            assert!(
+                CloudInitOptions::default()
+                    .with_authorized_keys(vec![bad.to_string()])
+                    .is_err(),
+                "{}",
+                bad
+            );
+        }
+    }
+
+    #[test]
+    fn test_multipart_user_data() {
+        let parts = [
+            UserDataPart {
+                content_type: "text/cloud-config",
+                filename: "base.yaml".to_string(),
+                content: "#cloud-config\npackages: [git]".to_string(),
+            },
+            UserDataPart {
+                content_type: "text/x-shellscript",
+                filename: "setup.sh".to_string(),
+                content: "#!/bin/sh\necho hi\n".to_string(),
+            },
+        ];
+        let document = multipart_user_data(&parts);
+        assert!(document.starts_with(
+            "Content-Type: multipart/mixed; boundary=\"==MEDA_USER_DATA_BOUNDARY==\"\n"
+        ));
+        assert_eq!(
+            document.matches("--==MEDA_USER_DATA_BOUNDARY==\n").count(),
+            2
+        );
+        assert!(document.contains(
+            "Content-Type: text/cloud-config; charset=\"utf-8\"\nMIME-Version: 1.0\n\
+             Content-Disposition: attachment; filename=\"base.yaml\"\n\n#cloud-config\npackages: [git]\n--"
+        ));
+        assert!(document.find("base.yaml").unwrap() < document.find("setup.sh").unwrap());
+        assert!(document.ends_with("echo hi\n--==MEDA_USER_DATA_BOUNDARY==--\n"));
+    }
+
+    #[test]
+    fn test_parse_resolv_conf_skips_loopback() {
+        let (servers, search) = parse_resolv_conf(
+            "# generated\nnameserver 127.0.0.53\nnameserver 10.1.0.2\n\
+             nameserver ::1\nsearch corp.example lab.example\noptions edns0\n",
+        );
+        assert_eq!(servers, vec!["10.1.0.2"]);
+        assert_eq!(search, vec!["corp.example", "lab.example"]);
+        assert_eq!(
+            parse_resolv_conf("nameserver 127.0.0.53\n"),
+            (vec![], vec![])
+        );
+    }
+
+    #[test]
+    fn test_network_config_static_address() {
+        let servers = vec!["10.0.0.53".to_string()];
+        let config = network_config("52:54:00:12:34:56", "192.168.42", &servers, &[]);
+        assert!(config.contains("macaddress: 52:54:00:12:34:56"));
+        assert!(config.contains("addresses: [192.168.42.2/24]"));
+        assert!(config.contains("gateway4: 192.168.42.1"));
+        assert!(config.contains("addresses: [10.0.0.53]"));
+        assert!(!config.contains("search:"));
+
+        let search = vec!["corp.example".to_string()];
+        let config = network_config("52:54:00:12:34:56", "192.168.42", &servers, &search);
+        assert!(config.contains("      search: [corp.example]\n"));
+    }
+
+    #[test]
+    fn test_network_data_json_matches_network_config() {
+        let servers = vec!["10.0.0.53".to_string()];
+        let data = network_data_json("52:54:00:12:34:56", "192.168.42", &servers);
+        assert_eq!(
+            data["links"][0]["ethernet_mac_address"],
+            "52:54:00:12:34:56"
+        );
+        assert_eq!(data["networks"][0]["ip_address"], "192.168.42.2");
+        assert_eq!(data["networks"][0]["routes"][0]["gateway"], "192.168.42.1");
+        assert_eq!(data["services"][0]["address"], "10.0.0.53");
+    }
+}
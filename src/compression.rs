@@ -0,0 +1,163 @@
+//! Stream compression for image archives. One helper so every path that
+//! writes a compressed artifact (today: `meda export`) picks and drives
+//! codecs the same way.
+//!
+//! gzip goes through flate2 in-process. zstd shells out to the `zstd`
+//! CLI rather than pulling in a C-backed crate: it is in every distro,
+//! multithreads with `-T0`, and exports are rare enough that a fork is
+//! irrelevant next to compressing a multi-GB disk.
+//!
+//! Push deliberately does NOT use this: registry uploads stay raw so
+//! pulls can write base.raw straight to disk, and a LAN registry is
+//! faster uncompressed anyway. Compression is an export-time choice.
+
+use crate::error::{Error, Result};
+use flate2::write::GzEncoder;
+use std::fs::File;
+use std::io::{self, Write};
+use std::process::{Child, ChildStdin, Command, Stdio};
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Compression {
+    None,
+    Gzip,
+    Zstd,
+}
+
+impl Compression {
+    pub fn parse(value: &str) -> Result<Self> {
+        match value.to_ascii_lowercase().as_str() {
+            "none" => Ok(Self::None),
+            "gzip" | "gz" => Ok(Self::Gzip),
+            "zstd" | "zst" => Ok(Self::Zstd),
+            other => Err(Error::Other(format!(
+                "Unknown compression '{}' (expected none, gzip or zstd)",
+                other
+            ))),
+        }
+    }
+
+    /// Wrap `file` in an encoder for this codec. Call
+    /// [`Encoder::finish`] when done — dropping it may lose the tail.
+    pub fn encoder(&self, file: File) -> Result<Encoder> {
+        match self {
+            Self::None => Ok(Encoder::Plain(file)),
+            Self::Gzip => Ok(Encoder::Gzip(GzEncoder::new(
+                file,
+                flate2::Compression::default(),
+            ))),
+            Self::Zstd => {
+                crate::util::ensure_dependency("zstd", "zstd")?;
+                let mut child = Command::new("zstd")
+                    .args(["-q", "-T0", "-c"])
+                    .stdin(Stdio::piped())
+                    .stdout(Stdio::from(file))
+                    .spawn()?;
+                let stdin = child
+                    .stdin
+                    .take()
+                    .ok_or_else(|| Error::Other("zstd stdin unavailable".to_string()))?;
+                Ok(Encoder::Zstd(child, Some(stdin)))
+            }
+        }
+    }
+}
+
+pub enum Encoder {
+    Plain(File),
+    Gzip(GzEncoder<File>),
+    Zstd(Child, Option<ChildStdin>),
+}
+
+impl Encoder {
+    /// Flush the codec trailer and, for zstd, wait for the compressor.
+    pub fn finish(self) -> Result<()> {
+        match self {
+            Self::Plain(mut file) => {
+                file.flush()?;
+            }
+            Self::Gzip(encoder) => {
+                encoder.finish()?.flush()?;
+            }
+            Self::Zstd(mut child, stdin) => {
+                // Closing stdin is what tells zstd the input is done.
+                drop(stdin);
+                let status = child.wait()?;
+                if !status.success() {
+                    return Err(Error::CommandFailed(format!("zstd exited with {}", status)));
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+impl Write for Encoder {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match self {
+            Self::Plain(file) => file.write(buf),
+            Self::Gzip(encoder) => encoder.write(buf),
+            Self::Zstd(_, Some(stdin)) => stdin.write(buf),
+            Self::Zstd(_, None) => Err(io::Error::new(
+                io::ErrorKind::BrokenPipe,
+                "zstd encoder already finished",
+            )),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match self {
+            Self::Plain(file) => file.flush(),
+            Self::Gzip(encoder) => encoder.flush(),
+            Self::Zstd(_, Some(stdin)) => stdin.flush(),
+            Self::Zstd(_, None) => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Read;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_parse() {
+        assert_eq!(Compression::parse("gzip").unwrap(), Compression::Gzip);
+        assert_eq!(Compression::parse("ZST").unwrap(), Compression::Zstd);
+        assert_eq!(Compression::parse("none").unwrap(), Compression::None);
+        assert!(Compression::parse("xz").is_err());
+    }
+
+    #[test]
+    fn test_gzip_roundtrip() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("out.gz");
+
+        let mut encoder = Compression::Gzip
+            .encoder(File::create(&path).unwrap())
+            .unwrap();
+        encoder.write_all(b"meda image bytes").unwrap();
+        encoder.finish().unwrap();
+
+        let mut decoded = String::new();
+        flate2::read::GzDecoder::new(File::open(&path).unwrap())
+            .read_to_string(&mut decoded)
+            .unwrap();
+        assert_eq!(decoded, "meda image bytes");
+    }
+
+    #[test]
+    fn test_none_writes_verbatim() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("out");
+
+        let mut encoder = Compression::None
+            .encoder(File::create(&path).unwrap())
+            .unwrap();
+        encoder.write_all(b"plain").unwrap();
+        encoder.finish().unwrap();
+
+        assert_eq!(std::fs::read(&path).unwrap(), b"plain");
+    }
+}
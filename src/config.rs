@@ -1,5 +1,6 @@
 use crate::chunking::ChunkingConfig;
 use crate::error::{Error, Result};
+use std::collections::HashMap;
 use std::env;
 use std::path::PathBuf;
 
@@ -22,6 +23,23 @@ pub struct Config {
     pub mem: String,
     pub disk_size: String,
     pub chunking: ChunkingConfig,
+    /// How many times a registry push is retried after a transient
+    /// failure (429 / 5xx / connection reset). Auth failures never retry.
+    pub push_retries: u32,
+    /// Per-registry overrides of `push_retries`
+    /// (`MEDA_PUSH_RETRIES_BY_REGISTRY`), keyed by registry host.
+    pub push_retries_by_registry: HashMap<String, u32>,
+    /// Where failed commands drop a diagnostics bundle
+    /// (`MEDA_DIAGNOSTICS_DIR`). Unset means no bundles.
+    pub diagnostics_dir: Option<PathBuf>,
+    /// Multiplier on a VM's disk size when checking free host disk
+    /// before create/run/create-image (`MEDA_CAPACITY_HEADROOM`, default
+    /// 1.0). 0 turns the pre-flight check off.
+    pub capacity_headroom: f64,
+    /// Registry host (optionally with port and path prefix) that pulls
+    /// are fetched through instead of the image's own registry
+    /// (`MEDA_PULL_MIRROR`). Pushes still go to the real registry.
+    pub pull_mirror: Option<String>,
 }
 
 impl Config {
@@ -48,9 +66,16 @@ impl Config {
 
         let base_raw = asset_dir.join("ubuntu-base.raw");
         let fw_bin = asset_dir.join("hypervisor-fw");
-        let ch_bin = asset_dir.join("cloud-hypervisor");
-        let cr_bin = asset_dir.join("ch-remote");
-        let oras_bin = asset_dir.join("oras");
+        // Binaries are downloaded into the asset dir unless overridden; an
+        // override is resolved (PATH lookup for bare names) and checked now.
+        let binary = |var: &str, default: &str| match env::var(var) {
+            Ok(spec) => crate::util::resolve_binary(&spec)
+                .map_err(|e| Error::Other(format!("{}: {}", var, e))),
+            Err(_) => Ok(asset_dir.join(default)),
+        };
+        let ch_bin = binary("MEDA_CH_BIN", "cloud-hypervisor")?;
+        let cr_bin = binary("MEDA_CH_REMOTE_BIN", "ch-remote")?;
+        let oras_bin = binary("MEDA_ORAS_BIN", "oras")?;
 
         let cpus = env::var("MEDA_CPUS")
             .map(|v| v.parse().unwrap_or(2))
@@ -81,6 +106,40 @@ impl Config {
             }
         }
 
+        let mut push_retries = 3;
+        if let Ok(retries) = env::var("MEDA_PUSH_RETRIES") {
+            if let Ok(parsed) = retries.parse::<u32>() {
+                push_retries = parsed.min(10);
+            }
+        }
+        // A malformed override only loses the per-registry counts; it must
+        // not take down every command that loads the config.
+        let push_retries_by_registry = match env::var("MEDA_PUSH_RETRIES_BY_REGISTRY") {
+            Ok(value) if !value.is_empty() => parse_registry_retries(&value).unwrap_or_else(|e| {
+                log::warn!("ignoring {}", e);
+                HashMap::new()
+            }),
+            _ => HashMap::new(),
+        };
+
+        let diagnostics_dir = env::var("MEDA_DIAGNOSTICS_DIR").ok().map(PathBuf::from);
+
+        let mut capacity_headroom = 1.0;
+        if let Ok(headroom) = env::var("MEDA_CAPACITY_HEADROOM") {
+            match headroom.parse::<f64>() {
+                Ok(parsed) if parsed.is_finite() && parsed >= 0.0 => capacity_headroom = parsed,
+                _ => log::warn!(
+                    "ignoring MEDA_CAPACITY_HEADROOM={} (expected a number >= 0)",
+                    headroom
+                ),
+            }
+        }
+
+        let pull_mirror = match env::var("MEDA_PULL_MIRROR") {
+            Ok(mirror) if !mirror.is_empty() => Some(parse_pull_mirror(&mirror)?),
+            _ => None,
+        };
+
         Ok(Self {
             ch_home,
             asset_dir,
@@ -99,6 +158,11 @@ impl Config {
             mem,
             disk_size,
             chunking,
+            push_retries,
+            push_retries_by_registry,
+            diagnostics_dir,
+            capacity_headroom,
+            pull_mirror,
         })
     }
 
@@ -106,6 +170,14 @@ impl Config {
         self.vm_root.join(name)
     }
 
+    /// Push retries for `registry`: its override, else `push_retries`.
+    pub fn push_retries_for(&self, registry: &str) -> u32 {
+        self.push_retries_by_registry
+            .get(registry)
+            .copied()
+            .unwrap_or(self.push_retries)
+    }
+
     pub fn ssh_dir(&self) -> PathBuf {
         self.ch_home.join("ssh")
     }
@@ -118,6 +190,62 @@ impl Config {
     }
 }
 
+/// Parse `MEDA_PUSH_RETRIES_BY_REGISTRY`: comma-separated
+/// `registry=retries` pairs (`ghcr.io=5,registry.local:5000=0`), with
+/// the same cap of 10 as `MEDA_PUSH_RETRIES`.
+fn parse_registry_retries(value: &str) -> Result<HashMap<String, u32>> {
+    value
+        .split(',')
+        .map(|entry| {
+            entry
+                .split_once('=')
+                .map(|(registry, retries)| (registry.trim(), retries.trim()))
+                .filter(|(registry, _)| !registry.is_empty() && !registry.contains('/'))
+                .and_then(|(registry, retries)| {
+                    let retries = retries.parse::<u32>().ok()?;
+                    Some((registry.to_string(), retries.min(10)))
+                })
+                .ok_or_else(|| {
+                    Error::Other(format!(
+                        "MEDA_PUSH_RETRIES_BY_REGISTRY: invalid entry '{}' (expected registry=retries)",
+                        entry
+                    ))
+                })
+        })
+        .collect()
+}
+
+/// Validate a `MEDA_PULL_MIRROR` value: `host[:port][/path/prefix]`,
+/// without a scheme since ORAS references don't take one.
+fn parse_pull_mirror(value: &str) -> Result<String> {
+    let mirror = value.trim_end_matches('/');
+    let (host_port, prefix) = mirror.split_once('/').unwrap_or((mirror, ""));
+    let (host, port) = host_port.split_once(':').unwrap_or((host_port, ""));
+    let valid_host = !host.is_empty()
+        && host.split('.').all(|label| {
+            !label.is_empty()
+                && !label.starts_with('-')
+                && !label.ends_with('-')
+                && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+        });
+    let valid_port = port.is_empty() || port.parse::<u16>().is_ok_and(|port| port > 0);
+    let valid_prefix = prefix.is_empty()
+        || prefix.split('/').all(|segment| {
+            !segment.is_empty()
+                && segment
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-'))
+        });
+    if valid_host && valid_port && valid_prefix {
+        Ok(mirror.to_string())
+    } else {
+        Err(Error::Other(format!(
+            "MEDA_PULL_MIRROR: invalid mirror '{}' (expected host[:port][/prefix], no scheme)",
+            value
+        )))
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -285,4 +413,83 @@ mod tests {
         env::remove_var("MEDA_ORAS_CONCURRENCY");
         env::remove_var("MEDA_ORAS_PUSH_CONCURRENCY");
     }
+
+    #[test]
+    #[serial]
+    fn test_push_retries_env_var() {
+        env::remove_var("MEDA_PUSH_RETRIES");
+        assert_eq!(Config::new().unwrap().push_retries, 3);
+
+        env::set_var("MEDA_PUSH_RETRIES", "5");
+        assert_eq!(Config::new().unwrap().push_retries, 5);
+
+        env::set_var("MEDA_PUSH_RETRIES", "99"); // Should be capped at 10
+        assert_eq!(Config::new().unwrap().push_retries, 10);
+
+        env::set_var("MEDA_PUSH_RETRIES", "2");
+        env::set_var(
+            "MEDA_PUSH_RETRIES_BY_REGISTRY",
+            "ghcr.io=6, registry.local:5000=0",
+        );
+        let config = Config::new().unwrap();
+        assert_eq!(config.push_retries_for("ghcr.io"), 6);
+        assert_eq!(config.push_retries_for("registry.local:5000"), 0);
+        assert_eq!(config.push_retries_for("quay.io"), 2);
+
+        env::set_var("MEDA_PUSH_RETRIES_BY_REGISTRY", "ghcr.io"); // Ignored
+        let config = Config::new().unwrap();
+        assert!(config.push_retries_by_registry.is_empty());
+        assert_eq!(config.push_retries_for("ghcr.io"), 2);
+
+        env::remove_var("MEDA_PUSH_RETRIES_BY_REGISTRY");
+        env::remove_var("MEDA_PUSH_RETRIES");
+    }
+
+    #[test]
+    #[serial]
+    fn test_capacity_headroom_env_var() {
+        env::remove_var("MEDA_CAPACITY_HEADROOM");
+        assert_eq!(Config::new().unwrap().capacity_headroom, 1.0);
+
+        env::set_var("MEDA_CAPACITY_HEADROOM", "1.5");
+        assert_eq!(Config::new().unwrap().capacity_headroom, 1.5);
+
+        env::set_var("MEDA_CAPACITY_HEADROOM", "-2"); // Ignored
+        assert_eq!(Config::new().unwrap().capacity_headroom, 1.0);
+
+        env::remove_var("MEDA_CAPACITY_HEADROOM");
+    }
+
+    #[test]
+    #[serial]
+    fn test_binary_override_env_var() {
+        env::set_var("MEDA_ORAS_BIN", "sh");
+        let config = Config::new().unwrap();
+        assert!(config.oras_bin.is_absolute());
+        assert!(config.oras_bin.ends_with("sh"));
+
+        env::set_var("MEDA_ORAS_BIN", "/nonexistent/oras");
+        let err = Config::new().err().unwrap().to_string();
+        assert!(err.contains("MEDA_ORAS_BIN"));
+
+        env::remove_var("MEDA_ORAS_BIN");
+        assert!(Config::new().unwrap().oras_bin.ends_with("oras"));
+    }
+
+    #[test]
+    fn test_parse_pull_mirror() {
+        assert_eq!(
+            parse_pull_mirror("mirror.corp:5000").unwrap(),
+            "mirror.corp:5000"
+        );
+        assert_eq!(
+            parse_pull_mirror("mirror.corp/ghcr.io/").unwrap(),
+            "mirror.corp/ghcr.io"
+        );
+        assert!(parse_pull_mirror("https://mirror.corp").is_err());
+        assert!(parse_pull_mirror("mirror.corp:0").is_err());
+        assert!(parse_pull_mirror("mirror..corp").is_err());
+        assert!(parse_pull_mirror("mirror.corp//x").is_err());
+        assert!(parse_pull_mirror("").is_err());
+    }
 }
@@ -9,6 +9,7 @@
 //! probe. The reasoning is the same as the admission module: better
 //! 503s than an OOM-kill that drags down the user's systemd session.
 
+use crate::error::{Error, Result};
 use std::fs;
 use std::path::Path;
 
@@ -70,3 +71,89 @@ pub fn total_disk_gb(vm_root: &Path) -> u64 {
         Err(_) => 0,
     }
 }
+
+/// MemAvailable from /proc/meminfo in bytes, or None if unreadable.
+pub fn available_mem_bytes() -> Option<u64> {
+    let body = fs::read_to_string("/proc/meminfo").ok()?;
+    body.lines()
+        .find_map(|line| line.strip_prefix("MemAvailable:"))
+        .and_then(|rest| rest.split_whitespace().next())
+        .and_then(|kb| kb.parse::<u64>().ok())
+        .map(|kb| kb * 1024)
+}
+
+/// Bytes available to unprivileged users on the filesystem holding
+/// `path` (or its nearest existing ancestor), or None if unknown.
+pub fn free_disk_bytes(path: &Path) -> Option<u64> {
+    let probe = path.ancestors().find(|p| p.exists())?;
+    let st = nix::sys::statvfs::statvfs(probe).ok()?;
+    #[allow(clippy::unnecessary_cast)]
+    Some((st.blocks_available() as u64) * (st.fragment_size() as u64))
+}
+
+/// Pre-flight for the CLI: fail before any work starts if the host
+/// can't hold `need_mem` bytes of guest RAM and `need_disk` bytes of
+/// disk under `disk_path`. Unlike admission, an unreadable probe skips
+/// the check: the CLI is interactive and the late failure still comes.
+pub fn preflight(need_mem: u64, need_disk: u64, disk_path: &Path) -> Result<()> {
+    check_capacity(
+        need_mem,
+        need_disk,
+        available_mem_bytes(),
+        free_disk_bytes(disk_path),
+    )
+}
+
+fn check_capacity(
+    need_mem: u64,
+    need_disk: u64,
+    available_mem: Option<u64>,
+    free_disk: Option<u64>,
+) -> Result<()> {
+    const GIB: f64 = 1024.0 * 1024.0 * 1024.0;
+    if let Some(available) = available_mem {
+        if need_mem > available {
+            return Err(Error::Other(format!(
+                "Not enough free memory: need {:.2} GiB, {:.2} GiB available",
+                need_mem as f64 / GIB,
+                available as f64 / GIB
+            )));
+        }
+    }
+    if let Some(free) = free_disk {
+        if need_disk > free {
+            return Err(Error::Other(format!(
+                "Not enough free disk: need {:.2} GiB (incl. headroom), {:.2} GiB free",
+                need_disk as f64 / GIB,
+                free as f64 / GIB
+            )));
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_check_capacity() {
+        const GIB: u64 = 1024 * 1024 * 1024;
+        assert!(check_capacity(2 * GIB, 10 * GIB, Some(4 * GIB), Some(20 * GIB)).is_ok());
+
+        let err = check_capacity(8 * GIB, GIB, Some(4 * GIB), None)
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("need 8.00 GiB, 4.00 GiB available"));
+
+        assert!(check_capacity(GIB, 30 * GIB, None, Some(20 * GIB)).is_err());
+        // Unknown host state never blocks
+        assert!(check_capacity(u64::MAX, u64::MAX, None, None).is_ok());
+    }
+
+    #[test]
+    fn test_free_disk_bytes_walks_up_to_existing_dir() {
+        let missing = std::env::temp_dir().join("meda-no-such-dir/deeper");
+        assert!(free_disk_bytes(&missing).is_some());
+    }
+}
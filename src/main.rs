@@ -2,16 +2,21 @@ mod admission;
 mod api;
 mod chunking;
 mod cli;
+mod cloud_init;
+mod compression;
 mod config;
+mod diagnostics;
 mod error;
 mod gpt;
 mod host_capacity;
 mod image;
 mod netns;
 mod network;
+mod provenance;
 mod snapshot;
 mod ssh;
 mod util;
+mod vagrant;
 mod vm;
 
 use clap::Parser;
@@ -29,11 +34,12 @@ async fn main() {
     }
 
     if let Err(e) = run().await {
+        let message = diagnostics::report(&e);
         // Only use logger if it was initialized, otherwise use eprintln
         if std::env::var("RUST_LOG").is_ok() {
-            error!("{}", e);
+            error!("{}", message);
         } else {
-            eprintln!("Error: {}", e);
+            eprintln!("Error: {}", message);
         }
         std::process::exit(1);
     }
@@ -50,12 +56,37 @@ async fn run() -> Result<()> {
         Commands::Create {
             name,
             user_data,
+            user_data_parts,
             force,
             memory,
             cpus,
             disk,
             device,
+            memory_backing,
+            swap,
+            cpu_quota,
+            memory_limit,
+            cpuset,
+            numa_node,
+            tpm,
+            subnet,
+            metadata_source,
+            guest_user,
+            guest_password,
+            dns_servers,
+            dns_search,
+            http_proxy,
+            https_proxy,
+            no_proxy,
+            timezone,
+            authorized_keys_github,
+            authorized_keys_agent,
+            hostname,
+            notes,
         } => {
+            if let Some(notes) = &notes {
+                vm::check_notes(notes)?;
+            }
             if force {
                 if !cli.json {
                     info!("Force flag set, removing existing VM if present");
@@ -80,8 +111,45 @@ async fn run() -> Result<()> {
                 cpus,
                 disk.as_deref(),
                 device,
-            );
-            vm::create(&config, &name, user_data.as_deref(), &resources, cli.json).await?;
+            )
+            .with_memory_options(memory_backing.as_deref(), swap.as_deref())?
+            .with_host_limits(cpu_quota.as_deref(), memory_limit.as_deref())?
+            .with_placement(cpuset.as_deref(), numa_node)?
+            .with_tpm(tpm)
+            .with_subnet(subnet.as_deref())?;
+            let cloud_init = cloud_init::CloudInitOptions::default()
+                .with_metadata_source(metadata_source.as_deref())?
+                .with_credentials(guest_user.as_deref(), guest_password.as_deref())?
+                .with_dns(&dns_servers, &dns_search)?
+                .with_proxy(
+                    http_proxy.as_deref(),
+                    https_proxy.as_deref(),
+                    no_proxy.as_deref(),
+                )?
+                .with_timezone(timezone.as_deref())?
+                .with_hostname(hostname.as_deref())?
+                .with_authorized_keys(
+                    ssh::extra_authorized_keys(&authorized_keys_github, authorized_keys_agent)
+                        .await?,
+                )?;
+            // Held until create returns; dropping it removes the file.
+            let parts_file = cloud_init::user_data_parts_file(&user_data_parts)?;
+            let user_data = match &parts_file {
+                Some(file) => file.path().to_str().map(str::to_string),
+                None => user_data,
+            };
+            vm::create(
+                &config,
+                &name,
+                user_data.as_deref(),
+                &resources,
+                &cloud_init,
+                cli.json,
+            )
+            .await?;
+            if let Some(notes) = &notes {
+                vm::store_notes(&config.vm_dir(&name), notes)?;
+            }
         }
         Commands::List => {
             vm::list(&config, cli.json).await?;
@@ -89,8 +157,25 @@ async fn run() -> Result<()> {
         Commands::Get { name } => {
             vm::get(&config, &name, cli.json).await?;
         }
-        Commands::Ip { name } => {
-            vm::ip(&config, &name, cli.json).await?;
+        Commands::Ip {
+            name,
+            source,
+            subnet,
+        } => {
+            vm::ip(
+                &config,
+                &name,
+                vm::IpSource::parse(&source)?,
+                subnet.as_deref(),
+                cli.json,
+            )
+            .await?;
+        }
+        Commands::Notes { name, notes } => {
+            vm::set_notes(&config, &name, &notes, cli.json)?;
+        }
+        Commands::Logs { name, tail } => {
+            vm::logs(&config, &name, tail, cli.json)?;
         }
         Commands::Start { name } => {
             vm::start(&config, &name, cli.json).await?;
@@ -143,21 +228,94 @@ async fn run() -> Result<()> {
             name,
             image,
             registry,
+            also_tags,
+            annotations,
+            remove_local,
+            squash,
+            tag_by_digest,
+            rollback_on_failure,
             dry_run,
         } => {
+            let options = image::PushOptions {
+                also_tags,
+                annotations,
+                remove_local,
+                squash,
+                tag_by_digest,
+                rollback_on_failure,
+                dry_run,
+            };
             image::push(
                 &config,
                 &name,
                 &image,
                 registry.as_deref(),
-                dry_run,
+                &options,
                 cli.json,
             )
             .await?;
         }
+        Commands::CheckPush { image, registry } => {
+            image::check_push_access(&config, &image, registry.as_deref(), cli.json).await?;
+        }
+        Commands::Promote {
+            source,
+            target,
+            dry_run,
+        } => {
+            image::promote(&config, &source, &target, dry_run, cli.json).await?;
+        }
         Commands::Images => {
             image::list(&config, cli.json).await?;
         }
+        Commands::Inspect {
+            image,
+            registry,
+            org,
+        } => {
+            image::inspect(
+                &config,
+                &image,
+                registry.as_deref(),
+                org.as_deref(),
+                cli.json,
+            )
+            .await?;
+        }
+        Commands::Flatten {
+            image,
+            target,
+            registry,
+            org,
+        } => {
+            image::flatten(
+                &config,
+                &image,
+                &target,
+                registry.as_deref(),
+                org.as_deref(),
+                cli.json,
+            )
+            .await?;
+        }
+        Commands::Provenance {
+            image,
+            registry,
+            org,
+            output,
+            sign,
+        } => {
+            provenance::generate(
+                &config,
+                &image,
+                registry.as_deref(),
+                org.as_deref(),
+                output.as_deref(),
+                sign,
+                cli.json,
+            )
+            .await?;
+        }
         Commands::Rmi {
             image,
             registry,
@@ -174,8 +332,22 @@ async fn run() -> Result<()> {
             )
             .await?;
         }
-        Commands::Prune { all, force } => {
-            image::prune(&config, all, force, cli.json).await?;
+        Commands::Prune {
+            all,
+            keep_last,
+            older_than,
+            name_prefix,
+            force,
+        } => {
+            let policy = image::PrunePolicy {
+                keep_last,
+                older_than: older_than
+                    .as_deref()
+                    .map(util::parse_duration_secs)
+                    .transpose()?,
+                name_prefix,
+            };
+            image::prune(&config, all, &policy, force, cli.json).await?;
         }
         Commands::CreateImage {
             name,
@@ -183,11 +355,48 @@ async fn run() -> Result<()> {
             registry,
             org,
             from_vm,
+            skip_if_exists,
+            inputs_hash,
+            allow_base_overwrite,
+            zero_free_space,
+            seal,
+            seal_command,
+            reproducible,
+            max_size,
+            delta,
+            guest_os,
+            capture_ci_env,
         } => {
             let default_registry = registry.as_deref().unwrap_or("ghcr.io");
             let default_org = org.as_deref().unwrap_or("cirunlabs");
 
             if let Some(vm_name) = from_vm {
+                let options = image::CreateImageOptions {
+                    skip_if_exists,
+                    inputs_hash,
+                    allow_base_overwrite,
+                    zero_free_space: zero_free_space
+                        .as_deref()
+                        .map(image::ZeroFreeSpace::parse)
+                        .transpose()?,
+                    seal_commands: image::seal_commands(seal, seal_command),
+                    source_date_epoch: if reproducible {
+                        Some(image::source_date_epoch_from_env()?)
+                    } else {
+                        None
+                    },
+                    max_size: max_size
+                        .as_deref()
+                        .map(util::parse_size_bytes)
+                        .transpose()?,
+                    delta,
+                    guest_os: guest_os.as_deref().map(image::parse_guest_os).transpose()?,
+                    ci_environment: if capture_ci_env {
+                        image::ci_environment_from_env()
+                    } else {
+                        Default::default()
+                    },
+                };
                 image::create_from_vm(
                     &config,
                     &vm_name,
@@ -195,6 +404,7 @@ async fn run() -> Result<()> {
                     &tag,
                     default_registry,
                     default_org,
+                    &options,
                     cli.json,
                 )
                 .await?;
@@ -210,19 +420,68 @@ async fn run() -> Result<()> {
                 .await?;
             }
         }
+        Commands::Export {
+            image,
+            output,
+            registry,
+            org,
+            compression,
+            format,
+            provider,
+            allow_overwrite_device,
+        } => {
+            image::export(
+                &config,
+                &image,
+                std::path::Path::new(&output),
+                registry.as_deref(),
+                org.as_deref(),
+                image::ExportFormat::parse(
+                    &format,
+                    compression.as_deref(),
+                    provider.as_deref(),
+                    allow_overwrite_device,
+                )?,
+                cli.json,
+            )
+            .await?;
+        }
         Commands::Run {
             image,
             name,
             registry,
             org,
             user_data,
+            user_data_parts,
             no_start,
             memory,
             cpus,
             disk,
             device,
+            memory_backing,
+            swap,
+            cpu_quota,
+            memory_limit,
+            cpuset,
+            numa_node,
+            tpm,
+            subnet,
+            metadata_source,
+            guest_user,
+            guest_password,
+            dns_servers,
+            dns_search,
+            http_proxy,
+            https_proxy,
+            no_proxy,
+            timezone,
+            authorized_keys_github,
+            authorized_keys_agent,
+            hostname,
             cold,
             ssh,
+            known_hosts,
+            strict_host_key,
         } => {
             let resources = vm::VmResources::from_config_with_overrides(
                 &config,
@@ -230,7 +489,17 @@ async fn run() -> Result<()> {
                 cpus,
                 disk.as_deref(),
                 device,
-            );
+            )
+            .with_memory_options(memory_backing.as_deref(), swap.as_deref())?
+            .with_host_limits(cpu_quota.as_deref(), memory_limit.as_deref())?
+            .with_placement(cpuset.as_deref(), numa_node)?
+            .with_tpm(tpm)
+            .with_subnet(subnet.as_deref())?;
+            let parts_file = cloud_init::user_data_parts_file(&user_data_parts)?;
+            let user_data = match &parts_file {
+                Some(file) => file.path().to_str().map(str::to_string),
+                None => user_data,
+            };
             let options = image::RunOptions {
                 vm_name: name.as_deref(),
                 registry: registry.as_deref(),
@@ -238,53 +507,80 @@ async fn run() -> Result<()> {
                 user_data_path: user_data.as_deref(),
                 no_start,
                 resources,
+                cloud_init: cloud_init::CloudInitOptions::default()
+                    .with_metadata_source(metadata_source.as_deref())?
+                    .with_credentials(guest_user.as_deref(), guest_password.as_deref())?
+                    .with_dns(&dns_servers, &dns_search)?
+                    .with_proxy(
+                        http_proxy.as_deref(),
+                        https_proxy.as_deref(),
+                        no_proxy.as_deref(),
+                    )?
+                    .with_timezone(timezone.as_deref())?
+                    .with_hostname(hostname.as_deref())?
+                    .with_authorized_keys(
+                        ssh::extra_authorized_keys(&authorized_keys_github, authorized_keys_agent)
+                            .await?,
+                    )?,
             };
-            // `run_instant` allocates a timestamped VM name when
-            // none is provided. With --ssh we need to know that
-            // name *after* run returns (to feed to `ssh`), so run
-            // the path in --json mode under the hood, parse the
-            // result, and then exec ssh.
+            // --cold forces the legacy cold path, as does anything the
+            // template/clone/restore flow can't honour.
+            let cold = cold || options.needs_cold_boot();
             if ssh {
-                let json_out = image::run_instant_capture(&config, &image, options).await?;
-                let host = json_out
-                    .get("host")
-                    .and_then(|v| v.as_str())
-                    .ok_or_else(|| error::Error::Other("no host IP in run output".into()))?;
-                let vm_name = json_out
-                    .get("vm")
-                    .and_then(|v| v.as_str())
-                    .unwrap_or("<vm>");
-                eprintln!("→ ssh cirun@{host}  (VM {vm_name}; keeps running after exit)");
+                // Both paths may allocate a timestamped VM name, so take
+                // it from what they return before exec'ing ssh.
+                let (vm_name, host) = if cold {
+                    let vm_name = image::run_from_image(&config, &image, options, cli.json).await?;
+                    image::wait_for_ssh(&config, &vm_name).await?;
+                    let host = vm::get_routable_ip(&config, &vm_name)?;
+                    (vm_name, host)
+                } else {
+                    let json_out = image::run_instant_capture(&config, &image, options).await?;
+                    let host = json_out
+                        .get("host")
+                        .and_then(|v| v.as_str())
+                        .ok_or_else(|| error::Error::Other("no host IP in run output".into()))?;
+                    let vm_name = json_out
+                        .get("vm")
+                        .and_then(|v| v.as_str())
+                        .unwrap_or("<vm>");
+                    (vm_name.to_string(), host.to_string())
+                };
+                let login = format!("{}@{}", vm::guest_user(&config, &vm_name), host);
+                eprintln!("→ ssh {login}  (VM {vm_name}; keeps running after exit)");
+                let identity = config.ssh_dir().join("id_ed25519");
+                let host_key_opts = ssh::host_key_options(
+                    known_hosts.as_deref().map(std::path::Path::new),
+                    strict_host_key,
+                    &config.vm_dir(&vm_name).join("known_hosts"),
+                );
                 let status = std::process::Command::new("ssh")
-                    .args([
-                        "-i",
-                        "/home/ubuntu/.meda/ssh/id_ed25519",
-                        "-o",
-                        "StrictHostKeyChecking=no",
-                        "-o",
-                        "UserKnownHostsFile=/dev/null",
-                        "-o",
-                        "ConnectTimeout=30",
-                        &format!("cirun@{host}"),
-                    ])
+                    .arg("-i")
+                    .arg(&identity)
+                    .args(&host_key_opts)
+                    .args(["-o", "ConnectTimeout=30", &login])
                     .status();
                 match status {
                     Ok(s) if s.success() => {}
                     Ok(s) => std::process::exit(s.code().unwrap_or(1)),
                     Err(e) => return Err(error::Error::Other(format!("ssh failed: {e}"))),
                 }
-            } else if cold || no_start {
-                // --cold forces the legacy cold path; --no-start doesn't
-                // make sense with the template/clone/restore flow, so
-                // fall back to the legacy code there too.
+            } else if cold {
                 image::run_from_image(&config, &image, options, cli.json).await?;
             } else {
                 image::run_instant(&config, &image, options, cli.json).await?;
             }
         }
-        Commands::Serve { port, host } => {
-            info!("Starting Meda API server on {}:{}", host, port);
+        Commands::Serve { port, host, socket } => {
             let config_arc = Arc::new(config);
+            if let Some(socket) = socket {
+                info!("Starting Meda API server on unix socket {}", socket);
+                let app = api::create_router(config_arc, "localhost", port);
+                api::serve_unix(app, std::path::Path::new(&socket)).await?;
+                return Ok(());
+            }
+
+            info!("Starting Meda API server on {}:{}", host, port);
             let app = api::create_router(config_arc, &host, port);
 
             let listener = tokio::net::TcpListener::bind(format!("{}:{}", host, port)).await?;
@@ -63,7 +63,8 @@ fn parse_192_168_slash_24_octet(dest: &str) -> Option<u8> {
     third.parse::<u8>().ok()
 }
 
-pub async fn generate_unique_subnet(config: &Config) -> Result<String> {
+/// Third octets of the `192.168.X.0/24` subnets already taken.
+fn subnet_octets_in_use(config: &Config) -> HashSet<u8> {
     // Start with subnets the kernel still has a connected route for. This
     // catches leaks from earlier delete attempts that failed to remove a tap
     // device — the VM dir is gone but the route survives, and picking that
@@ -89,6 +90,53 @@ pub async fn generate_unique_subnet(config: &Config) -> Result<String> {
             }
         }
     }
+    used_subnets
+}
+
+/// Normalise a `--subnet` value (`192.168.X`, `192.168.X.0` or
+/// `192.168.X.0/24`) to the `192.168.X` form stored per VM.
+pub fn parse_subnet(value: &str) -> Result<String> {
+    let trimmed = value.strip_suffix("/24").unwrap_or(value);
+    let trimmed = trimmed.strip_suffix(".0").unwrap_or(trimmed);
+    match trimmed
+        .strip_prefix("192.168.")
+        .and_then(|octet| octet.parse::<u8>().ok())
+    {
+        Some(octet) if (1..=254).contains(&octet) => Ok(format!("192.168.{}", octet)),
+        _ => Err(Error::Other(format!(
+            "Invalid subnet '{}' (expected 192.168.X with X in 1-254, e.g. 192.168.77)",
+            value
+        ))),
+    }
+}
+
+/// The requested subnet if it is still free, else an error naming the
+/// ones in use; a random free one when none was requested.
+pub async fn pick_subnet(config: &Config, requested: Option<&str>) -> Result<String> {
+    let Some(requested) = requested else {
+        return generate_unique_subnet(config).await;
+    };
+    let subnet = parse_subnet(requested)?;
+    let used = subnet_octets_in_use(config);
+    let octet = subnet.rsplit('.').next().and_then(|o| o.parse::<u8>().ok());
+    if octet.is_some_and(|octet| used.contains(&octet)) {
+        let mut taken: Vec<u8> = used.into_iter().collect();
+        taken.sort_unstable();
+        return Err(Error::Other(format!(
+            "Subnet {} is already in use (taken: {})",
+            subnet,
+            taken
+                .iter()
+                .map(|o| format!("192.168.{}", o))
+                .collect::<Vec<_>>()
+                .join(", ")
+        )));
+    }
+    Ok(subnet)
+}
+
+pub async fn generate_unique_subnet(config: &Config) -> Result<String> {
+    let used_subnets = subnet_octets_in_use(config);
 
     let mut attempts = 0;
     let max_attempts = 200;
@@ -540,6 +588,36 @@ mod tests {
         assert_ne!(subnet, "192.168.100");
     }
 
+    #[test]
+    fn test_parse_subnet() {
+        assert_eq!(parse_subnet("192.168.77").unwrap(), "192.168.77");
+        assert_eq!(parse_subnet("192.168.77.0/24").unwrap(), "192.168.77");
+        assert_eq!(parse_subnet("192.168.77.0").unwrap(), "192.168.77");
+        assert!(parse_subnet("10.0.0").is_err());
+        assert!(parse_subnet("192.168.0").is_err());
+        assert!(parse_subnet("192.168.300").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_pick_subnet_rejects_taken() {
+        let temp_dir = TempDir::new().unwrap();
+
+        let vm_dir = temp_dir.path().join("test-vm");
+        std::fs::create_dir_all(&vm_dir).unwrap();
+        std::fs::write(vm_dir.join("subnet"), "192.168.100").unwrap();
+
+        env::set_var("MEDA_VM_DIR", temp_dir.path().to_str().unwrap());
+        let config = Config::new().unwrap();
+        env::remove_var("MEDA_VM_DIR");
+
+        let err = pick_subnet(&config, Some("192.168.100")).await.unwrap_err();
+        assert!(err.to_string().contains("192.168.100"));
+        assert!(pick_subnet(&config, None)
+            .await
+            .unwrap()
+            .starts_with("192.168."));
+    }
+
     #[test]
     fn test_mac_address_uniqueness() {
         let mut macs = std::collections::HashSet::new();
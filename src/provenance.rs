@@ -0,0 +1,338 @@
+//! SLSA provenance for local images (`meda provenance`).
+//!
+//! Writes an in-toto v1 statement with a SLSA v1 predicate next to the
+//! image and registers it as an artifact, so `meda push` uploads it
+//! alongside the disk (or to `--output`, left out of the image). The
+//! subject is the sha256 of the disk as pushed, so a delta is hashed
+//! flattened; inputs come from what the manifest already records: the
+//! VM it was captured from, the inputs hash, and the base image with
+//! the digest it was pulled at.
+//!
+//! The statement is a single JSON line (`.intoto.jsonl`, the usual
+//! attestation bundle name), which also keeps pull from mistaking it
+//! for a manifest. Signing shells out to `cosign sign-blob` and is
+//! fail-soft: without cosign or `COSIGN_KEY` the statement is still
+//! written, just unsigned.
+
+use crate::config::Config;
+use crate::error::{Error, Result};
+use crate::image::{ImageManifest, ImageRef, ImageResult};
+use log::warn;
+use sha2::{Digest, Sha256};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+pub const STATEMENT_FILE: &str = "provenance.intoto.jsonl";
+const SIGNATURE_FILE: &str = "provenance.intoto.jsonl.sig";
+
+/// Metadata keys that describe how the image was built rather than
+/// what it was built from.
+const EXTERNAL_PARAMETERS: [&str; 4] = [
+    "source_vm",
+    "inputs_hash",
+    "source_date_epoch",
+    "image_format",
+];
+
+/// Hex sha256 of a file, streamed so multi-GB disks don't load into memory.
+fn sha256_file(path: &Path) -> Result<String> {
+    let mut hasher = Sha256::new();
+    io::copy(&mut fs::File::open(path)?, &mut hasher)?;
+    Ok(format!("{:x}", hasher.finalize()))
+}
+
+/// Hex sha256 of `disk` as `meda push` uploads it. Push flattens a
+/// delta to raw, so a delta is flattened next to it, hashed and
+/// removed again; a raw disk is hashed as is.
+fn pushed_disk_sha256(manifest: &ImageManifest, disk: &Path) -> Result<String> {
+    if !manifest.is_delta() {
+        return sha256_file(disk);
+    }
+    let flattened = disk.with_extension("provenance.raw");
+    let digest = crate::util::run_command(
+        "qemu-img",
+        &[
+            "convert",
+            "-f",
+            "qcow2",
+            "-O",
+            "raw",
+            disk.to_str().unwrap(),
+            flattened.to_str().unwrap(),
+        ],
+    )
+    .and_then(|_| sha256_file(&flattened));
+    fs::remove_file(&flattened).ok();
+    digest
+}
+
+/// `sha256:<hex>` as an in-toto digest set.
+fn digest_set(digest: &str) -> serde_json::Value {
+    match digest.split_once(':') {
+        Some((algorithm, hex)) => serde_json::json!({ algorithm: hex }),
+        None => serde_json::json!({ "sha256": digest }),
+    }
+}
+
+fn statement(reference: &str, disk_sha256: &str, manifest: &ImageManifest) -> serde_json::Value {
+    let external: serde_json::Map<String, serde_json::Value> = EXTERNAL_PARAMETERS
+        .iter()
+        .filter_map(|key| {
+            manifest
+                .metadata
+                .get(*key)
+                .map(|value| (key.to_string(), value.clone().into()))
+        })
+        .collect();
+
+    let mut dependencies = Vec::new();
+    if let Some(source) = manifest.metadata.get("source_image") {
+        let mut dependency = serde_json::json!({ "uri": source });
+        if let Some(digest) = manifest.metadata.get("source_digest") {
+            dependency["digest"] = digest_set(digest);
+        }
+        dependencies.push(dependency);
+    }
+
+    let finished = chrono::DateTime::from_timestamp(manifest.created as i64, 0)
+        .unwrap_or_default()
+        .to_rfc3339();
+
+    serde_json::json!({
+        "_type": "https://in-toto.io/Statement/v1",
+        "subject": [{
+            "name": reference,
+            "digest": { "sha256": disk_sha256 },
+        }],
+        "predicateType": "https://slsa.dev/provenance/v1",
+        "predicate": {
+            "buildDefinition": {
+                "buildType": "https://github.com/cirunlabs/meda/create-image@v1",
+                "externalParameters": external,
+                "resolvedDependencies": dependencies,
+            },
+            "runDetails": {
+                "builder": {
+                    "id": "https://github.com/cirunlabs/meda",
+                    "version": { "meda": env!("CARGO_PKG_VERSION") },
+                },
+                "metadata": { "finishedOn": finished },
+            },
+        },
+    })
+}
+
+/// Sign `statement` with cosign into `signature`. Returns whether it
+/// did; every reason not to is only a warning.
+fn sign(statement: &Path, signature: &Path) -> bool {
+    let Ok(key) = std::env::var("COSIGN_KEY") else {
+        warn!("COSIGN_KEY is not set; leaving the provenance unsigned");
+        return false;
+    };
+    if crate::util::check_dependency("cosign").is_err() {
+        warn!("cosign not found; leaving the provenance unsigned");
+        return false;
+    }
+    match crate::util::run_command_with_output(
+        "cosign",
+        &[
+            "sign-blob",
+            "--yes",
+            "--key",
+            &key,
+            "--output-signature",
+            signature.to_str().unwrap(),
+            statement.to_str().unwrap(),
+        ],
+    ) {
+        Ok(output) if output.status.success() => true,
+        Ok(output) => {
+            warn!(
+                "cosign failed; leaving the provenance unsigned: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+            false
+        }
+        Err(e) => {
+            warn!("cosign failed; leaving the provenance unsigned: {}", e);
+            false
+        }
+    }
+}
+
+/// Write (and with `sign`, try to sign) the provenance for a local
+/// image and add it to the image's artifacts, or write it to `output`
+/// (signature at `<output>.sig`) without touching the image.
+pub async fn generate(
+    config: &Config,
+    image: &str,
+    registry: Option<&str>,
+    org: Option<&str>,
+    output: Option<&str>,
+    sign_statement: bool,
+    json: bool,
+) -> Result<()> {
+    let image_ref = ImageRef::parse(
+        image,
+        registry.unwrap_or("ghcr.io"),
+        org.unwrap_or("cirunlabs"),
+    )?;
+    let image_dir = image_ref.local_dir(config);
+    let mut manifest = ImageManifest::load(&image_dir).map_err(|_| {
+        Error::ImageNotFound(format!("Local image '{}' not found", image_ref.url()))
+    })?;
+    let disk = manifest
+        .artifacts
+        .get("base_image")
+        .map(|file| image_dir.join(file))
+        .ok_or_else(|| Error::Other(format!("Image {} has no disk", image_ref.url())))?;
+
+    if !json {
+        println!("🔏 Hashing {} for provenance", disk.display());
+    }
+    let (statement_path, signature_path) = match output {
+        Some(output) => (
+            PathBuf::from(output),
+            PathBuf::from(format!("{}.sig", output)),
+        ),
+        None => (
+            image_dir.join(STATEMENT_FILE),
+            image_dir.join(SIGNATURE_FILE),
+        ),
+    };
+    let body = statement(
+        &image_ref.url(),
+        &pushed_disk_sha256(&manifest, &disk)?,
+        &manifest,
+    );
+    fs::write(
+        &statement_path,
+        format!("{}\n", serde_json::to_string(&body)?),
+    )?;
+
+    let signed = sign_statement && sign(&statement_path, &signature_path);
+    if !signed {
+        // A stale signature from an earlier run no longer matches.
+        fs::remove_file(&signature_path).ok();
+    }
+    if output.is_none() {
+        manifest
+            .artifacts
+            .insert("provenance".to_string(), STATEMENT_FILE.to_string());
+        if signed {
+            manifest.artifacts.insert(
+                "provenance_signature".to_string(),
+                SIGNATURE_FILE.to_string(),
+            );
+        } else {
+            manifest.artifacts.remove("provenance_signature");
+        }
+        manifest.save(&image_dir)?;
+    }
+
+    let message = format!(
+        "Wrote {}provenance for {} to {}",
+        if signed { "signed " } else { "" },
+        image_ref.url(),
+        statement_path.display()
+    );
+    if json {
+        let result = ImageResult {
+            success: true,
+            message,
+        };
+        println!("{}", serde_json::to_string_pretty(&result)?);
+    } else {
+        println!("✅ {}", message);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_sha256_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("disk");
+        fs::write(&path, b"abc").unwrap();
+        assert_eq!(
+            sha256_file(&path).unwrap(),
+            "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+        );
+    }
+
+    #[test]
+    fn test_pushed_disk_sha256_raw_is_file_hash() {
+        let temp_dir = TempDir::new().unwrap();
+        let disk = temp_dir.path().join("base.raw");
+        fs::write(&disk, b"abc").unwrap();
+        let mut artifacts = HashMap::new();
+        artifacts.insert("base_image".to_string(), "base.raw".to_string());
+        let manifest = ImageManifest {
+            name: "app".to_string(),
+            tag: "v1".to_string(),
+            registry: "ghcr.io".to_string(),
+            org: "cirunlabs".to_string(),
+            artifacts,
+            metadata: HashMap::new(),
+            created: 0,
+        };
+        assert!(!manifest.is_delta());
+        assert_eq!(
+            pushed_disk_sha256(&manifest, &disk).unwrap(),
+            sha256_file(&disk).unwrap()
+        );
+    }
+
+    #[test]
+    fn test_statement_records_inputs() {
+        let mut metadata = HashMap::new();
+        metadata.insert("source_vm".to_string(), "builder".to_string());
+        metadata.insert("inputs_hash".to_string(), "sha256:0f3a".to_string());
+        metadata.insert(
+            "source_image".to_string(),
+            "ghcr.io/cirunlabs/ubuntu:latest".to_string(),
+        );
+        metadata.insert("source_digest".to_string(), "sha256:abc".to_string());
+        metadata.insert("pulled_at".to_string(), "1".to_string());
+        let manifest = ImageManifest {
+            name: "app".to_string(),
+            tag: "v1".to_string(),
+            registry: "ghcr.io".to_string(),
+            org: "cirunlabs".to_string(),
+            artifacts: HashMap::new(),
+            metadata,
+            created: 0,
+        };
+
+        let body = statement("ghcr.io/cirunlabs/app:v1", "deadbeef", &manifest);
+        assert_eq!(body["_type"], "https://in-toto.io/Statement/v1");
+        assert_eq!(body["subject"][0]["name"], "ghcr.io/cirunlabs/app:v1");
+        assert_eq!(body["subject"][0]["digest"]["sha256"], "deadbeef");
+
+        let definition = &body["predicate"]["buildDefinition"];
+        assert_eq!(definition["externalParameters"]["source_vm"], "builder");
+        assert_eq!(
+            definition["externalParameters"]["inputs_hash"],
+            "sha256:0f3a"
+        );
+        assert!(definition["externalParameters"].get("pulled_at").is_none());
+        assert_eq!(
+            definition["resolvedDependencies"][0]["uri"],
+            "ghcr.io/cirunlabs/ubuntu:latest"
+        );
+        assert_eq!(
+            definition["resolvedDependencies"][0]["digest"]["sha256"],
+            "abc"
+        );
+        assert_eq!(
+            body["predicate"]["runDetails"]["metadata"]["finishedOn"],
+            "1970-01-01T00:00:00+00:00"
+        );
+    }
+}
@@ -322,6 +322,8 @@ pub async fn clone_template(
         "user-data",
         "start.sh",
         "devices",
+        "source_image",
+        "guest_user",
     ] {
         let s = src.join(f);
         if s.exists() {
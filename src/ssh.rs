@@ -3,6 +3,7 @@ use crate::error::{Error, Result};
 use log::info;
 use std::fs;
 use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
 use std::process::Command;
 
 pub struct SshKeyPair {
@@ -63,6 +64,137 @@ pub fn ensure_ssh_keypair(config: &Config) -> Result<SshKeyPair> {
     })
 }
 
+/// Builds the `-o` options that control host key verification for an
+/// interactive `ssh` into a meda VM.
+///
+/// - `known_hosts` set: the user supplied a known_hosts file, so verify
+///   against it and refuse unknown or changed keys
+///   (`StrictHostKeyChecking=yes`).
+/// - `strict` set without a file: pin the key on first connect to
+///   `pin_file` (the VM's own known_hosts) and refuse a changed key on
+///   every later connect (`accept-new`).
+/// - neither: the historical behaviour — VMs are ephemeral and their
+///   host keys change on every rebuild, so don't verify at all.
+pub fn host_key_options(known_hosts: Option<&Path>, strict: bool, pin_file: &Path) -> Vec<String> {
+    let (checking, file) = match known_hosts {
+        Some(path) => ("yes", path.display().to_string()),
+        None if strict => ("accept-new", pin_file.display().to_string()),
+        None => ("no", "/dev/null".to_string()),
+    };
+    vec![
+        "-o".to_string(),
+        format!("StrictHostKeyChecking={}", checking),
+        "-o".to_string(),
+        format!("UserKnownHostsFile={}", file),
+    ]
+}
+
+/// Runs `command` inside a running meda VM as its login user (`cirun`
+/// unless created with `--guest-user`), authenticating with meda's own key. Non-interactive (BatchMode) so a
+/// guest without our key fails fast instead of prompting. Returns
+/// stdout on success.
+pub fn run_in_vm(config: &Config, vm_name: &str, command: &str) -> Result<String> {
+    let host = crate::vm::get_routable_ip(config, vm_name)?;
+    let identity = config.ssh_dir().join("id_ed25519");
+    let output = Command::new("ssh")
+        .arg("-i")
+        .arg(&identity)
+        .args(host_key_options(None, false, Path::new("/dev/null")))
+        .args(["-o", "BatchMode=yes", "-o", "ConnectTimeout=10"])
+        .arg(format!(
+            "{}@{}",
+            crate::vm::guest_user(config, vm_name),
+            host
+        ))
+        .arg(command)
+        .output()?;
+
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        return Err(Error::CommandFailed(format!(
+            "ssh {} '{}' failed: {}",
+            vm_name,
+            command,
+            stderr.trim()
+        )));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+/// Non-empty lines of an `authorized_keys`-style listing.
+fn key_lines(body: &str) -> Vec<String> {
+    body.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+/// Public keys GitHub publishes for `user` at
+/// `https://github.com/<user>.keys`. A user without keys is an error,
+/// since asking for them means someone expects to log in.
+pub async fn github_keys(user: &str) -> Result<Vec<String>> {
+    let valid = !user.is_empty()
+        && user.len() <= 39
+        && !user.starts_with('-')
+        && user.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+    if !valid {
+        return Err(Error::Other(format!("Invalid GitHub user name '{}'", user)));
+    }
+    let response = reqwest::get(format!("https://github.com/{}.keys", user)).await?;
+    if !response.status().is_success() {
+        return Err(Error::Other(format!(
+            "Fetching SSH keys of GitHub user {} failed: HTTP {}",
+            user,
+            response.status()
+        )));
+    }
+    let keys = key_lines(&response.text().await?);
+    if keys.is_empty() {
+        return Err(Error::Other(format!(
+            "GitHub user {} has no public SSH keys",
+            user
+        )));
+    }
+    Ok(keys)
+}
+
+/// Public keys loaded in the caller's ssh-agent (`ssh-add -L`).
+pub fn agent_keys() -> Result<Vec<String>> {
+    if std::env::var_os("SSH_AUTH_SOCK").is_none() {
+        return Err(Error::Other(
+            "SSH_AUTH_SOCK is not set; no ssh-agent to take keys from".to_string(),
+        ));
+    }
+    let output = Command::new("ssh-add").arg("-L").output()?;
+    // Also exits non-zero (with the reason on stdout) when the agent
+    // holds no identities.
+    if !output.status.success() {
+        return Err(Error::Other(format!(
+            "Listing ssh-agent keys failed: {}{}",
+            String::from_utf8_lossy(&output.stdout).trim(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+    Ok(key_lines(&String::from_utf8_lossy(&output.stdout)))
+}
+
+/// Extra keys to authorise in the guest: those of each GitHub user,
+/// then the agent's when `from_agent` is set.
+pub async fn extra_authorized_keys(
+    github_users: &[String],
+    from_agent: bool,
+) -> Result<Vec<String>> {
+    let mut keys = Vec::new();
+    for user in github_users {
+        keys.extend(github_keys(user).await?);
+    }
+    if from_agent {
+        keys.extend(agent_keys()?);
+    }
+    Ok(keys)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -123,4 +255,36 @@ mod tests {
         std::env::remove_var("MEDA_ASSET_DIR");
         std::env::remove_var("MEDA_VM_DIR");
     }
+
+    #[test]
+    fn test_host_key_options_default_is_insecure() {
+        let opts = host_key_options(None, false, Path::new("/vms/a/known_hosts"));
+        assert_eq!(
+            opts,
+            vec![
+                "-o",
+                "StrictHostKeyChecking=no",
+                "-o",
+                "UserKnownHostsFile=/dev/null"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_host_key_options_strict_pins_to_vm_file() {
+        let opts = host_key_options(None, true, Path::new("/vms/a/known_hosts"));
+        assert!(opts.contains(&"StrictHostKeyChecking=accept-new".to_string()));
+        assert!(opts.contains(&"UserKnownHostsFile=/vms/a/known_hosts".to_string()));
+    }
+
+    #[test]
+    fn test_host_key_options_user_file_wins() {
+        let opts = host_key_options(
+            Some(Path::new("/etc/ssh/meda_known_hosts")),
+            false,
+            Path::new("/vms/a/known_hosts"),
+        );
+        assert!(opts.contains(&"StrictHostKeyChecking=yes".to_string()));
+        assert!(opts.contains(&"UserKnownHostsFile=/etc/ssh/meda_known_hosts".to_string()));
+    }
 }
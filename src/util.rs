@@ -3,7 +3,7 @@ use indicatif::{ProgressBar, ProgressStyle};
 use log::debug;
 use std::fs;
 use std::io::Write;
-use std::path::Path;
+use std::path::{Path, PathBuf};
 use std::process::{Command, Output};
 use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
@@ -163,6 +163,90 @@ pub fn ensure_dependency(program: &str, package: &str) -> Result<()> {
     Ok(())
 }
 
+/// Resolve a user-supplied binary override to an absolute path. A value
+/// containing `/` is taken as a path; a bare name is looked up on PATH.
+/// Either way the result must be an executable file, so a typo fails
+/// here rather than as a spawn error halfway through a VM start.
+pub fn resolve_binary(spec: &str) -> Result<PathBuf> {
+    use std::os::unix::fs::PermissionsExt;
+
+    let is_executable = |path: &Path| {
+        fs::metadata(path)
+            .map(|m| m.is_file() && m.permissions().mode() & 0o111 != 0)
+            .unwrap_or(false)
+    };
+
+    if spec.contains('/') {
+        let path = Path::new(spec);
+        if !path.exists() {
+            return Err(Error::Other(format!("Binary '{}' does not exist", spec)));
+        }
+        if !is_executable(path) {
+            return Err(Error::Other(format!("Binary '{}' is not executable", spec)));
+        }
+        return Ok(fs::canonicalize(path)?);
+    }
+
+    let search_path = std::env::var_os("PATH").unwrap_or_default();
+    std::env::split_paths(&search_path)
+        .map(|dir| dir.join(spec))
+        .find(|candidate| is_executable(candidate))
+        .ok_or_else(|| {
+            Error::Other(format!(
+                "Binary '{}' not found on PATH (searched: {})",
+                spec,
+                search_path.to_string_lossy()
+            ))
+        })
+}
+
+/// Parse a size like `512M` or `20G` (binary units, bare number =
+/// bytes) into bytes.
+pub fn parse_size_bytes(size: &str) -> Result<u64> {
+    let size = size.trim();
+    let split_at = size
+        .find(|c: char| c.is_ascii_alphabetic())
+        .unwrap_or(size.len());
+    let (digits, unit) = size.split_at(split_at);
+    let invalid = || Error::Other(format!("Invalid size '{}' (expected e.g. 512M, 20G)", size));
+    let n: u64 = digits.trim().parse().map_err(|_| invalid())?;
+    let multiplier: u64 = match unit.to_ascii_uppercase().as_str() {
+        "" | "B" => 1,
+        "K" | "KB" | "KIB" => 1 << 10,
+        "M" | "MB" | "MIB" => 1 << 20,
+        "G" | "GB" | "GIB" => 1 << 30,
+        "T" | "TB" | "TIB" => 1 << 40,
+        _ => return Err(invalid()),
+    };
+    n.checked_mul(multiplier).ok_or_else(invalid)
+}
+
+/// Parse an age like `90m`, `12h`, `7d` or `2w` (bare number =
+/// seconds) into seconds.
+pub fn parse_duration_secs(duration: &str) -> Result<u64> {
+    let duration = duration.trim();
+    let split_at = duration
+        .find(|c: char| c.is_ascii_alphabetic())
+        .unwrap_or(duration.len());
+    let (digits, unit) = duration.split_at(split_at);
+    let invalid = || {
+        Error::Other(format!(
+            "Invalid duration '{}' (expected e.g. 12h, 7d, 2w)",
+            duration
+        ))
+    };
+    let n: u64 = digits.trim().parse().map_err(|_| invalid())?;
+    let multiplier: u64 = match unit.to_ascii_lowercase().as_str() {
+        "" | "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 24 * 60 * 60,
+        "w" => 7 * 24 * 60 * 60,
+        _ => return Err(invalid()),
+    };
+    n.checked_mul(multiplier).ok_or_else(invalid)
+}
+
 pub fn check_process_running(pid: u32) -> bool {
     match Command::new("ps").args(["-p", &pid.to_string()]).output() {
         Ok(output) => output.status.success(),
@@ -242,6 +326,26 @@ pub fn create_qcow2_overlay_with_fmt(
     run_command_quietly("qemu-img", &args)
 }
 
+/// Guest-visible size of a disk image: the file length for raw, the
+/// size recorded in the header for qcow2.
+pub fn disk_virtual_size(path: &Path, is_qcow2: bool) -> Result<u64> {
+    if !is_qcow2 {
+        return Ok(fs::metadata(path)?.len());
+    }
+    let info = run_command_with_output(
+        "qemu-img",
+        &["info", "--output=json", path.to_str().unwrap()],
+    )?;
+    serde_json::from_slice::<serde_json::Value>(&info.stdout)?["virtual-size"]
+        .as_u64()
+        .ok_or_else(|| {
+            Error::Other(format!(
+                "qemu-img info reported no virtual size for {}",
+                path.display()
+            ))
+        })
+}
+
 pub fn write_string_to_file(path: &Path, content: &str) -> Result<()> {
     fs::write(path, content).map_err(Error::Io)
 }
@@ -297,6 +401,48 @@ mod tests {
     use std::fs;
     use tempfile::NamedTempFile;
 
+    #[test]
+    fn test_parse_duration_secs() {
+        assert_eq!(parse_duration_secs("90m").unwrap(), 90 * 60);
+        assert_eq!(parse_duration_secs("7d").unwrap(), 7 * 24 * 60 * 60);
+        assert_eq!(parse_duration_secs("2W").unwrap(), 14 * 24 * 60 * 60);
+        assert_eq!(parse_duration_secs("30").unwrap(), 30);
+        assert!(parse_duration_secs("soon").is_err());
+        assert!(parse_duration_secs("3y").is_err());
+    }
+
+    #[test]
+    fn test_parse_size_bytes() {
+        assert_eq!(parse_size_bytes("512M").unwrap(), 512 * 1024 * 1024);
+        assert_eq!(parse_size_bytes("20G").unwrap(), 20 * 1024 * 1024 * 1024);
+        assert_eq!(parse_size_bytes("1gib").unwrap(), 1024 * 1024 * 1024);
+        assert_eq!(parse_size_bytes("4096").unwrap(), 4096);
+        assert!(parse_size_bytes("big").is_err());
+        assert!(parse_size_bytes("10X").is_err());
+        assert!(parse_size_bytes("99999999999T").is_err());
+    }
+
+    #[test]
+    fn test_resolve_binary() {
+        use std::os::unix::fs::PermissionsExt;
+
+        // Bare names go through PATH
+        let sh = resolve_binary("sh").unwrap();
+        assert!(sh.is_absolute());
+        assert!(resolve_binary("definitely-not-a-meda-binary").is_err());
+
+        // Paths must exist and be executable
+        let file = NamedTempFile::new().unwrap();
+        let path = file.path().to_str().unwrap();
+        assert!(resolve_binary(path).is_err());
+        fs::set_permissions(file.path(), fs::Permissions::from_mode(0o755)).unwrap();
+        assert_eq!(
+            resolve_binary(path).unwrap(),
+            fs::canonicalize(file.path()).unwrap()
+        );
+        assert!(resolve_binary("/nonexistent/cloud-hypervisor").is_err());
+    }
+
     #[test]
     fn test_run_command_success() {
         let result = run_command("echo", &["hello"]);
@@ -0,0 +1,147 @@
+//! Vagrant box packaging for `meda export --format vagrant`.
+//!
+//! A box is a gzipped tarball with, at its root:
+//!
+//! - `box.img`: the image's disk as qcow2 (converted from base.raw, or
+//!   flattened from a delta);
+//! - `metadata.json`: provider, disk format and virtual size in GB;
+//! - `Vagrantfile`: defaults merged under the user's own Vagrantfile.
+//!
+//! Both supported providers (vagrant-libvirt and vagrant-qemu) take the
+//! same layout. The box logs in as the user meda's default user-data
+//! creates; images built with a custom `--guest-user` need
+//! `config.ssh.username` set in the consuming Vagrantfile.
+
+use crate::cloud_init::DEFAULT_GUEST_USER;
+use crate::error::{Error, Result};
+use crate::util::write_string_to_file;
+use std::fs;
+use std::path::Path;
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum BoxProvider {
+    #[default]
+    Libvirt,
+    Qemu,
+}
+
+impl BoxProvider {
+    pub fn parse(value: &str) -> Result<Self> {
+        match value.to_ascii_lowercase().as_str() {
+            "libvirt" => Ok(Self::Libvirt),
+            "qemu" => Ok(Self::Qemu),
+            other => Err(Error::Other(format!(
+                "Unknown Vagrant provider '{}' (expected libvirt or qemu)",
+                other
+            ))),
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Libvirt => "libvirt",
+            Self::Qemu => "qemu",
+        }
+    }
+}
+
+/// `metadata.json` for a box whose disk is `disk_bytes` large.
+fn metadata_json(provider: BoxProvider, disk_bytes: u64) -> serde_json::Value {
+    const GB: u64 = 1024 * 1024 * 1024;
+    serde_json::json!({
+        "provider": provider.as_str(),
+        "format": "qcow2",
+        "virtual_size": disk_bytes.div_ceil(GB),
+    })
+}
+
+/// The box's embedded Vagrantfile. The password matches meda's default
+/// user-data; Vagrant swaps in its own key on first `vagrant up`.
+fn vagrantfile(provider: BoxProvider) -> String {
+    let provider_block = match provider {
+        BoxProvider::Libvirt => {
+            "  config.vm.provider :libvirt do |libvirt|\n    libvirt.driver = \"kvm\"\n  end\n"
+        }
+        // vagrant-qemu's defaults already fit a meda disk.
+        BoxProvider::Qemu => "",
+    };
+    format!(
+        r#"# Generated by meda
+Vagrant.configure("2") do |config|
+  config.ssh.username = "{user}"
+  config.ssh.password = "{user}"
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+{provider_block}end
+"#,
+        user = DEFAULT_GUEST_USER,
+        provider_block = provider_block,
+    )
+}
+
+/// Package `disk` (raw, or a qcow2 delta when `disk_is_qcow2`) as a box
+/// at `output`. `work_dir` holds the converted disk until it is archived.
+pub fn build_box(
+    disk: &Path,
+    disk_is_qcow2: bool,
+    provider: BoxProvider,
+    work_dir: &Path,
+    output: &Path,
+) -> Result<()> {
+    fs::create_dir_all(work_dir)?;
+    let box_img = work_dir.join("box.img");
+    crate::util::run_command(
+        "qemu-img",
+        &[
+            "convert",
+            "-f",
+            if disk_is_qcow2 { "qcow2" } else { "raw" },
+            "-O",
+            "qcow2",
+            disk.to_str().unwrap(),
+            box_img.to_str().unwrap(),
+        ],
+    )?;
+
+    let disk_bytes = crate::util::disk_virtual_size(disk, disk_is_qcow2)?;
+    write_string_to_file(
+        &work_dir.join("metadata.json"),
+        &serde_json::to_string_pretty(&metadata_json(provider, disk_bytes))?,
+    )?;
+    write_string_to_file(&work_dir.join("Vagrantfile"), &vagrantfile(provider))?;
+
+    let encoder = crate::compression::Compression::Gzip.encoder(fs::File::create(output)?)?;
+    let mut archive = tar::Builder::new(encoder);
+    for file in ["metadata.json", "Vagrantfile", "box.img"] {
+        archive.append_path_with_name(work_dir.join(file), file)?;
+    }
+    archive.into_inner()?.finish()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_box_provider_parse() {
+        assert_eq!(BoxProvider::parse("libvirt").unwrap(), BoxProvider::Libvirt);
+        assert_eq!(BoxProvider::parse("QEMU").unwrap(), BoxProvider::Qemu);
+        assert!(BoxProvider::parse("virtualbox").is_err());
+    }
+
+    #[test]
+    fn test_metadata_json_rounds_size_up() {
+        let data = metadata_json(BoxProvider::Libvirt, 20 * 1024 * 1024 * 1024 + 1);
+        assert_eq!(data["provider"], "libvirt");
+        assert_eq!(data["format"], "qcow2");
+        assert_eq!(data["virtual_size"], 21);
+    }
+
+    #[test]
+    fn test_vagrantfile_per_provider() {
+        let libvirt = vagrantfile(BoxProvider::Libvirt);
+        assert!(libvirt.contains("config.ssh.username = \"cirun\""));
+        assert!(libvirt.contains("config.vm.provider :libvirt"));
+        assert!(!vagrantfile(BoxProvider::Qemu).contains("config.vm.provider"));
+    }
+}
@@ -1,3 +1,4 @@
+use crate::cloud_init::CloudInitOptions;
 use crate::config::Config;
 use crate::error::{Error, Result};
 use crate::netns::NetnsSpec;
@@ -20,6 +21,420 @@ pub struct VmResources {
     pub cpus: u8,
     pub disk_size: String,
     pub devices: Vec<String>,
+    pub memory_backing: MemoryBacking,
+    /// Guest swap file size (e.g. 2G). Only applied through the
+    /// generated default user-data.
+    pub swap_size: Option<String>,
+    /// Host-side caps on the hypervisor process itself.
+    pub host_limits: HostLimits,
+    /// Attach a TPM 2.0 emulated by swtpm.
+    pub tpm: bool,
+    /// Pinned `192.168.X` subnet instead of a random free one.
+    pub subnet: Option<String>,
+}
+
+/// Host-level cgroup caps for a VM's Cloud Hypervisor process, applied
+/// by launching it in a transient systemd scope. Unlike `--cpus` and
+/// `--memory`, which size the guest, these bound what the VM can take
+/// from the host (vCPU threads plus device emulation and hypervisor
+/// overhead), so a busy VM can't starve its neighbours on a shared box.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct HostLimits {
+    /// CPUQuota in percent of one core (200 = two cores).
+    pub cpu_quota: Option<u32>,
+    /// MemoryMax in bytes.
+    pub memory_max: Option<u64>,
+    /// AllowedCPUs: host CPUs the VM is pinned to, as a cpuset list
+    /// (`0-3,8`).
+    pub cpuset: Option<String>,
+    /// AllowedMemoryNodes: the host NUMA node guest RAM comes from.
+    pub numa_node: Option<u32>,
+}
+
+impl HostLimits {
+    pub fn parse(cpu_quota: Option<&str>, memory_limit: Option<&str>) -> Result<Self> {
+        let cpu_quota = cpu_quota
+            .map(|quota| {
+                quota
+                    .trim_end_matches('%')
+                    .parse::<u32>()
+                    .ok()
+                    .filter(|q| *q > 0)
+                    .ok_or_else(|| {
+                        Error::Other(format!(
+                            "Invalid CPU quota '{}' (expected a percentage, e.g. 200%)",
+                            quota
+                        ))
+                    })
+            })
+            .transpose()?;
+        let memory_max = memory_limit
+            .map(crate::util::parse_size_bytes)
+            .transpose()?;
+        Ok(Self {
+            cpu_quota,
+            memory_max,
+            ..Default::default()
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.cpu_quota.is_none() && self.memory_max.is_none() && !self.has_placement()
+    }
+
+    /// Whether the VM is pinned to host CPUs or a NUMA node.
+    pub fn has_placement(&self) -> bool {
+        self.cpuset.is_some() || self.numa_node.is_some()
+    }
+
+    /// Pin the VM to `cpuset` and/or `numa_node`. A NUMA node without a
+    /// cpuset pins to that node's CPUs, so vCPUs and RAM stay local.
+    /// The node is checked against the host when it exposes its
+    /// topology in `/sys`.
+    pub fn with_placement(mut self, cpuset: Option<&str>, numa_node: Option<u32>) -> Result<Self> {
+        if let Some(cpuset) = cpuset {
+            if !valid_cpuset(cpuset) {
+                return Err(Error::Other(format!(
+                    "Invalid CPU set '{}' (expected a list such as 0-3,8)",
+                    cpuset
+                )));
+            }
+            self.cpuset = Some(cpuset.to_string());
+        }
+        if let Some(node) = numa_node {
+            let nodes = std::path::Path::new(NUMA_NODES_DIR);
+            if nodes.is_dir() {
+                let node_dir = nodes.join(format!("node{}", node));
+                if !node_dir.is_dir() {
+                    return Err(Error::Other(format!(
+                        "NUMA node {} does not exist on this host",
+                        node
+                    )));
+                }
+                if self.cpuset.is_none() {
+                    self.cpuset = fs::read_to_string(node_dir.join("cpulist"))
+                        .ok()
+                        .map(|list| list.trim().to_string())
+                        .filter(|list| valid_cpuset(list));
+                }
+            }
+            self.numa_node = Some(node);
+        }
+        Ok(self)
+    }
+
+    /// Shell prefix that runs the rest of the line in a transient scope
+    /// with these limits, or "" when there are none. `--scope` execs the
+    /// command in place, so `$!` in start.sh is still the hypervisor's
+    /// pid. Non-root start scripts go through the user's manager.
+    pub fn systemd_run_prefix(&self) -> String {
+        if self.is_empty() {
+            return String::new();
+        }
+        let mut prefix = String::from(
+            "systemd-run $([ \"$(id -u)\" = 0 ] || echo --user) --scope --quiet --collect",
+        );
+        if let Some(quota) = self.cpu_quota {
+            prefix.push_str(&format!(" -p CPUQuota={}%", quota));
+        }
+        if let Some(bytes) = self.memory_max {
+            prefix.push_str(&format!(" -p MemoryMax={}", bytes));
+        }
+        if let Some(cpuset) = &self.cpuset {
+            prefix.push_str(&format!(" -p AllowedCPUs={}", cpuset));
+        }
+        if let Some(node) = self.numa_node {
+            prefix.push_str(&format!(" -p AllowedMemoryNodes={}", node));
+        }
+        prefix.push(' ');
+        prefix
+    }
+
+    /// Fail if limits were asked for but can't be applied, and warn on
+    /// hosts where they would be silently ignored.
+    pub(crate) fn check_host(&self) -> Result<()> {
+        if self.is_empty() {
+            return Ok(());
+        }
+        crate::util::ensure_dependency("systemd-run", "systemd")?;
+        let controllers =
+            fs::read_to_string("/sys/fs/cgroup/cgroup.controllers").unwrap_or_default();
+        if controllers.is_empty() {
+            warn!("host is not on cgroup v2; CPU/memory limits for the VM may not be enforced");
+        } else if self.has_placement() && !controllers.split_whitespace().any(|c| c == "cpuset") {
+            warn!("cgroup cpuset controller is not enabled; CPU/NUMA pinning may not be enforced");
+        }
+        Ok(())
+    }
+
+    /// Record the CPU/NUMA placement in the VM dir (`placement`), so a
+    /// benchmark run can be tied back to where it ran.
+    pub(crate) fn store_placement(&self, vm_dir: &std::path::Path) -> Result<()> {
+        if !self.has_placement() {
+            return Ok(());
+        }
+        let mut placement = String::new();
+        if let Some(cpuset) = &self.cpuset {
+            placement.push_str(&format!("cpus={}\n", cpuset));
+        }
+        if let Some(node) = self.numa_node {
+            placement.push_str(&format!("numa_node={}\n", node));
+        }
+        write_string_to_file(&vm_dir.join("placement"), &placement)
+    }
+}
+
+/// Where Linux lists the host's NUMA nodes (`node0`, `node1`, ...).
+const NUMA_NODES_DIR: &str = "/sys/devices/system/node";
+
+/// A cpuset list as systemd's AllowedCPUs takes it: comma-separated
+/// CPUs or ascending ranges.
+fn valid_cpuset(cpuset: &str) -> bool {
+    !cpuset.is_empty()
+        && cpuset.split(',').all(|item| match item.split_once('-') {
+            Some((start, end)) => matches!(
+                (start.parse::<u32>(), end.parse::<u32>()),
+                (Ok(start), Ok(end)) if start <= end
+            ),
+            None => item.parse::<u32>().is_ok(),
+        })
+}
+
+/// How guest RAM is backed on the host, mapped onto Cloud Hypervisor's
+/// `--memory` parameters.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum MemoryBacking {
+    /// Plain anonymous memory (CH default).
+    #[default]
+    Anonymous,
+    /// Back guest RAM with host hugepages (`hugepages=on`). Needs
+    /// hugepages reserved on the host, e.g. `vm.nr_hugepages`.
+    Hugepages,
+    /// Shared, file (memfd) backed memory (`shared=on`), required for
+    /// vhost-user devices such as virtiofs.
+    Shared,
+}
+
+impl MemoryBacking {
+    pub fn parse(value: &str) -> Result<Self> {
+        match value.to_ascii_lowercase().as_str() {
+            "default" | "anonymous" => Ok(Self::Anonymous),
+            "hugepages" => Ok(Self::Hugepages),
+            "shared" | "file" => Ok(Self::Shared),
+            other => Err(Error::Other(format!(
+                "Unknown memory backing '{}' (expected default, hugepages or shared)",
+                other
+            ))),
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Anonymous => "default",
+            Self::Hugepages => "hugepages",
+            Self::Shared => "shared",
+        }
+    }
+
+    /// Extra parameters appended to `--memory size=<mem>`.
+    pub fn ch_memory_params(&self) -> &'static str {
+        match self {
+            Self::Anonymous => "",
+            Self::Hugepages => ",hugepages=on",
+            Self::Shared => ",shared=on",
+        }
+    }
+}
+
+/// Hugepage-backed guests fail at CH startup with a fairly opaque mmap
+/// error when the host has none reserved; flag it up front instead.
+fn warn_if_hugepages_unavailable() {
+    let meminfo = fs::read_to_string("/proc/meminfo").unwrap_or_default();
+    let free = meminfo
+        .lines()
+        .find_map(|l| l.strip_prefix("HugePages_Free:"))
+        .and_then(|v| v.trim().parse::<u64>().ok())
+        .unwrap_or(0);
+    if free == 0 {
+        warn!(
+            "hugepages memory backing requested but the host has no free hugepages \
+             (set vm.nr_hugepages); the VM will likely fail to start"
+        );
+    }
+}
+
+/// Write the memory backing next to the other resource files and warn
+/// if the host looks unable to honour it.
+pub(crate) fn store_memory_backing(
+    vm_dir: &std::path::Path,
+    resources: &VmResources,
+) -> Result<()> {
+    if resources.memory_backing == MemoryBacking::Hugepages {
+        warn_if_hugepages_unavailable();
+    }
+    write_string_to_file(
+        &vm_dir.join("memory_backing"),
+        resources.memory_backing.as_str(),
+    )
+}
+
+/// cloud-config for the default `cirun` user, authorised with meda's
+/// SSH key. `swap_size` adds a swap file section when set.
+///
+/// Configured credentials replace the demo `cirun`/`cirun` login: the
+/// user gets meda's key, and password auth is only switched on when a
+/// password was given explicitly. Without them the legacy demo user is
+/// kept as-is.
+pub(crate) fn default_user_data(
+    public_key: &str,
+    swap_size: Option<&str>,
+    cloud_init: &CloudInitOptions,
+) -> String {
+    // meda's key, then any extra keys as JSON strings (valid YAML
+    // scalars) since their comments may contain anything.
+    let authorized_keys: String = std::iter::once(public_key.to_string())
+        .chain(
+            cloud_init
+                .authorized_keys
+                .iter()
+                .map(|key| serde_json::Value::String(key.clone()).to_string()),
+        )
+        .map(|key| format!("      - {}\n", key))
+        .collect();
+    let mut user_data = if cloud_init.has_credentials() {
+        let mut user_data = format!(
+            r#"#cloud-config
+users:
+  - name: {}
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    lock_passwd: {}
+    groups: sudo
+    shell: /bin/bash
+    ssh_authorized_keys:
+{}ssh_pwauth: {}
+"#,
+            cloud_init.guest_user(),
+            cloud_init.guest_password.is_none(),
+            authorized_keys,
+            cloud_init.guest_password.is_some()
+        );
+        if let Some(password) = &cloud_init.guest_password {
+            // A JSON string is a valid double-quoted YAML scalar, so
+            // this escapes anything the password contains.
+            user_data.push_str(&format!(
+                "chpasswd:\n  expire: false\n  users:\n    - name: {}\n      password: {}\n      type: text\n",
+                cloud_init.guest_user(),
+                serde_json::Value::String(password.clone())
+            ));
+        }
+        user_data
+    } else {
+        format!(
+            r#"#cloud-config
+users:
+  - name: cirun
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    passwd: $6$ep7LxhhmhQHf.TiY$qPJVJQCnPMnyFdmD0ymP7CH2dos0awET8JlSzDqoiK6AOQwDpx8fCLJ1C5c7nvkVJbIpQCOalC8l2BGkRzogM.
+    lock_passwd: false
+    inactive: false
+    groups: sudo
+    shell: /bin/bash
+    ssh_authorized_keys:
+{}ssh_pwauth: true
+"#,
+            authorized_keys
+        )
+    };
+    if let Some(size) = swap_size {
+        user_data.push_str(&format!(
+            "swap:\n  filename: /swap.img\n  size: {}\n  maxsize: {}\n",
+            size, size
+        ));
+    }
+    user_data.push_str(&cloud_init.proxy_user_data());
+    user_data.push_str(&cloud_init.time_user_data());
+    user_data
+}
+
+/// Record the SSH login user for a VM so later `run_in_vm` calls (seal,
+/// zero-free-space, ...) log in as the right account.
+pub(crate) fn store_guest_user(
+    vm_dir: &std::path::Path,
+    cloud_init: &CloudInitOptions,
+) -> Result<()> {
+    write_string_to_file(&vm_dir.join("guest_user"), cloud_init.guest_user())
+}
+
+/// Longest note `--notes` / `meda notes` accept, to keep `meda list`
+/// readable.
+const MAX_NOTES_LEN: usize = 200;
+
+/// Check a VM note: a single line of at most [`MAX_NOTES_LEN`] characters.
+pub fn check_notes(notes: &str) -> Result<()> {
+    if notes.chars().count() > MAX_NOTES_LEN || notes.chars().any(char::is_control) {
+        return Err(Error::Other(format!(
+            "VM notes must be a single line of at most {} characters",
+            MAX_NOTES_LEN
+        )));
+    }
+    Ok(())
+}
+
+/// Attach a free-form note (which build created the VM, who owns it)
+/// shown by `meda list` and `meda get`. An empty note removes it.
+pub fn store_notes(vm_dir: &std::path::Path, notes: &str) -> Result<()> {
+    check_notes(notes)?;
+    let path = vm_dir.join("notes");
+    if notes.is_empty() {
+        if path.exists() {
+            fs::remove_file(path)?;
+        }
+        Ok(())
+    } else {
+        write_string_to_file(&path, notes)
+    }
+}
+
+/// The note attached to `name`, if any.
+pub fn get_vm_notes(config: &Config, name: &str) -> Option<String> {
+    fs::read_to_string(config.vm_dir(name).join("notes"))
+        .ok()
+        .map(|notes| notes.trim().to_string())
+        .filter(|notes| !notes.is_empty())
+}
+
+/// `meda notes`: set, or with an empty note clear, a VM's note.
+pub fn set_notes(config: &Config, name: &str, notes: &str, json: bool) -> Result<()> {
+    let vm_dir = config.vm_dir(name);
+    if !vm_dir.exists() {
+        return Err(Error::VmNotFound(name.to_string()));
+    }
+    store_notes(&vm_dir, notes)?;
+
+    let message = if notes.is_empty() {
+        format!("Cleared the notes of VM {}", name)
+    } else {
+        format!("Updated the notes of VM {}", name)
+    };
+    if json {
+        let result = VmResult {
+            success: true,
+            message,
+        };
+        println!("{}", serde_json::to_string_pretty(&result)?);
+    } else {
+        println!("✅ {}", message);
+    }
+    Ok(())
+}
+
+/// The SSH login user recorded for `name`, `cirun` for older VMs.
+pub fn guest_user(config: &Config, name: &str) -> String {
+    fs::read_to_string(config.vm_dir(name).join("guest_user"))
+        .map(|user| user.trim().to_string())
+        .ok()
+        .filter(|user| !user.is_empty())
+        .unwrap_or_else(|| crate::cloud_init::DEFAULT_GUEST_USER.to_string())
 }
 
 impl VmResources {
@@ -35,8 +450,113 @@ impl VmResources {
             cpus: cpus.unwrap_or(config.cpus as u8),
             disk_size: disk_size.unwrap_or(&config.disk_size).to_string(),
             devices,
+            memory_backing: MemoryBacking::default(),
+            swap_size: None,
+            host_limits: HostLimits::default(),
+            tpm: false,
+            subnet: None,
         }
     }
+
+    /// Pin the VM's subnet (`--subnet`), validating the format. Whether
+    /// it is free is only known when the VM is created.
+    pub fn with_subnet(mut self, subnet: Option<&str>) -> Result<Self> {
+        self.subnet = subnet.map(crate::network::parse_subnet).transpose()?;
+        Ok(self)
+    }
+
+    /// Attach a software TPM (`--tpm`).
+    pub fn with_tpm(mut self, tpm: bool) -> Self {
+        self.tpm = tpm;
+        self
+    }
+
+    /// Fail if a TPM was asked for but swtpm isn't installed.
+    pub(crate) fn check_tpm_host(&self) -> Result<()> {
+        if self.tpm {
+            ensure_dependency("swtpm", "swtpm")?;
+        }
+        Ok(())
+    }
+
+    /// start.sh line that launches the VM's swtpm, keeping its state in
+    /// `vm_dir/tpm`, or "" without a TPM. `--terminate` makes swtpm exit
+    /// once Cloud Hypervisor disconnects, so stop and delete need no
+    /// extra cleanup.
+    pub(crate) fn swtpm_command(&self, vm_dir: &std::path::Path) -> String {
+        if !self.tpm {
+            return String::new();
+        }
+        format!(
+            "mkdir -p \"{dir}/tpm\" && swtpm socket --tpm2 --tpmstate dir=\"{dir}/tpm\" \
+             --ctrl type=unixio,path=\"{dir}/swtpm.sock\" --terminate --daemon\n",
+            dir = vm_dir.display()
+        )
+    }
+
+    /// Cloud Hypervisor argument connecting the guest to that swtpm.
+    pub(crate) fn ch_tpm_args(&self, vm_dir: &std::path::Path) -> String {
+        if !self.tpm {
+            return String::new();
+        }
+        format!(" \\\n  --tpm socket=\"{}/swtpm.sock\"", vm_dir.display())
+    }
+
+    /// Apply optional host-side CPU/memory caps (`--cpu-quota`,
+    /// `--memory-limit`), validating both.
+    pub fn with_host_limits(
+        mut self,
+        cpu_quota: Option<&str>,
+        memory_limit: Option<&str>,
+    ) -> Result<Self> {
+        self.host_limits = HostLimits::parse(cpu_quota, memory_limit)?;
+        Ok(self)
+    }
+
+    /// Apply optional `--cpuset` / `--numa-node` pinning.
+    pub fn with_placement(mut self, cpuset: Option<&str>, numa_node: Option<u32>) -> Result<Self> {
+        self.host_limits = self.host_limits.with_placement(cpuset, numa_node)?;
+        Ok(self)
+    }
+
+    /// Apply the optional memory backing and guest swap settings,
+    /// validating both. The swap size is stored in bytes, so cloud-init
+    /// reads it the same whichever unit it was given in.
+    pub fn with_memory_options(
+        mut self,
+        memory_backing: Option<&str>,
+        swap_size: Option<&str>,
+    ) -> Result<Self> {
+        if let Some(backing) = memory_backing {
+            self.memory_backing = MemoryBacking::parse(backing)?;
+        }
+        if let Some(size) = swap_size {
+            match crate::util::parse_size_bytes(size) {
+                Ok(bytes) if bytes > 0 => self.swap_size = Some(bytes.to_string()),
+                _ => {
+                    return Err(Error::Other(format!(
+                        "Invalid swap size '{}' (expected e.g. 512M, 2G)",
+                        size
+                    )))
+                }
+            }
+        }
+        Ok(self)
+    }
+}
+
+/// Fail early if the host can't fit the guest RAM of a VM about to
+/// start, against MemAvailable. The disk isn't checked: it's a qcow2
+/// overlay that starts out nearly empty whatever its virtual size, so
+/// the size says nothing about what creating it writes. Skipped with a
+/// `capacity_headroom` of 0; a size that doesn't parse is left to fail
+/// where it's used.
+pub(crate) fn preflight_capacity(config: &Config, resources: &VmResources) -> Result<()> {
+    if config.capacity_headroom == 0.0 {
+        return Ok(());
+    }
+    let need_mem = crate::util::parse_size_bytes(&resources.memory).unwrap_or(0);
+    crate::host_capacity::preflight(need_mem, 0, &config.vm_root)
 }
 
 fn validate_device_paths(devices: &[String]) -> Result<()> {
@@ -68,6 +588,7 @@ pub struct VmInfo {
     pub disk: String,
     pub devices: Vec<String>,
     pub created: String,
+    pub notes: Option<String>,
 }
 
 #[derive(Serialize)]
@@ -236,6 +757,7 @@ pub async fn create(
     name: &str,
     user_data_path: Option<&str>,
     resources: &VmResources,
+    cloud_init: &CloudInitOptions,
     json: bool,
 ) -> Result<()> {
     let vm_dir = config.vm_dir(name);
@@ -248,9 +770,28 @@ pub async fn create(
         info!("Creating VM: {}", name);
     }
 
+    // Reject anything the host can't honour before touching disk, so a
+    // bad option doesn't leave a half-created VM holding the name.
+    resources.host_limits.check_host()?;
+    resources.check_tpm_host()?;
+    if !resources.devices.is_empty() {
+        validate_device_paths(&resources.devices)?;
+    }
+
     // Bootstrap to ensure we have the necessary binaries
     bootstrap(config).await?;
 
+    // Reap any tap devices leaked by a prior delete so we don't pick a subnet
+    // that still has a stale connected route via a linkdown orphan.
+    if let Err(e) = crate::network::cleanup_orphaned_tap_devices(config).await {
+        log::warn!("orphan tap reap before VM create failed: {}", e);
+    }
+
+    // Generate network config with a unique (or the pinned) subnet
+    let subnet = crate::network::pick_subnet(config, resources.subnet.as_deref()).await?;
+    // Generate unique TAP device name
+    let tap_name = crate::network::generate_unique_tap_name(config, name).await?;
+
     // Create VM directory
     fs::create_dir_all(&vm_dir)?;
 
@@ -267,17 +808,6 @@ pub async fn create(
     }
     crate::util::create_qcow2_overlay(&config.base_raw, &vm_rootfs, Some(&resources.disk_size))?;
 
-    // Reap any tap devices leaked by a prior delete so we don't pick a subnet
-    // that still has a stale connected route via a linkdown orphan.
-    if let Err(e) = crate::network::cleanup_orphaned_tap_devices(config).await {
-        log::warn!("orphan tap reap before VM create failed: {}", e);
-    }
-
-    // Generate network config with a unique subnet
-    let subnet = crate::network::generate_unique_subnet(config).await?;
-    // Generate unique TAP device name
-    let tap_name = crate::network::generate_unique_tap_name(config, name).await?;
-
     // Store network config
     write_string_to_file(&vm_dir.join("subnet"), &subnet)?;
     write_string_to_file(&vm_dir.join("tapdev"), &tap_name)?;
@@ -286,90 +816,57 @@ pub async fn create(
     write_string_to_file(&vm_dir.join("memory"), &resources.memory)?;
     write_string_to_file(&vm_dir.join("cpus"), &resources.cpus.to_string())?;
     write_string_to_file(&vm_dir.join("disk_size"), &resources.disk_size)?;
+    store_memory_backing(&vm_dir, resources)?;
+    resources.host_limits.store_placement(&vm_dir)?;
 
-    // Validate and store VFIO device configuration
+    // Store VFIO device configuration
     if !resources.devices.is_empty() {
-        validate_device_paths(&resources.devices)?;
         write_string_to_file(&vm_dir.join("devices"), &resources.devices.join("\n"))?;
     }
 
     // Create cloud-init files
-    let meta_data = format!("instance-id: {}\nlocal-hostname: {}\n", name, name);
+    let meta_data = format!(
+        "instance-id: {}\nlocal-hostname: {}\n",
+        name,
+        cloud_init.hostname(name)
+    );
     write_string_to_file(&vm_dir.join("meta-data"), &meta_data)?;
 
     // User data
     if let Some(path) = user_data_path {
         fs::copy(path, vm_dir.join("user-data"))?;
+        if resources.swap_size.is_some()
+            || cloud_init.has_credentials()
+            || !cloud_init.proxy_user_data().is_empty()
+            || cloud_init.timezone.is_some()
+            || !cloud_init.authorized_keys.is_empty()
+        {
+            warn!(
+                "--swap, guest credentials, proxies, --timezone and extra authorized keys only apply \
+                 to the default user-data; ignoring them for {}",
+                path
+            );
+        }
     } else {
         let keypair = crate::ssh::ensure_ssh_keypair(config)?;
-        let default_user_data = format!(
-            r#"#cloud-config
-users:
-  - name: cirun
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    passwd: $6$ep7LxhhmhQHf.TiY$qPJVJQCnPMnyFdmD0ymP7CH2dos0awET8JlSzDqoiK6AOQwDpx8fCLJ1C5c7nvkVJbIpQCOalC8l2BGkRzogM.
-    lock_passwd: false
-    inactive: false
-    groups: sudo
-    shell: /bin/bash
-    ssh_authorized_keys:
-      - {}
-ssh_pwauth: true
-"#,
-            keypair.public_key
+        let default_user_data = default_user_data(
+            &keypair.public_key,
+            resources.swap_size.as_deref(),
+            cloud_init,
         );
         write_string_to_file(&vm_dir.join("user-data"), &default_user_data)?;
     }
+    store_guest_user(&vm_dir, cloud_init)?;
 
     // Generate MAC address
     let mac = generate_random_mac();
     write_string_to_file(&vm_dir.join("mac"), &mac)?;
 
     // Create cloud-init ISO
-    let ci_dir = vm_dir.join("ci");
-    fs::create_dir_all(&ci_dir)?;
-
-    // Copy cloud-init files to ci directory
-    for file in ["meta-data", "user-data"] {
-        let src = vm_dir.join(file);
-        let dst = ci_dir.join(file);
-        fs::copy(&src, &dst)?;
-    }
-
-    // Create network-config
-    let network_config = format!(
-        r#"version: 2
-ethernets:
-  ens4:
-    match:
-       macaddress: {}
-    addresses: [{}.2/24]
-    gateway4: {}.1
-    set-name: ens4
-    nameservers:
-      addresses: [8.8.8.8, 1.1.1.1]
-"#,
-        mac, subnet, subnet
-    );
-    write_string_to_file(&ci_dir.join("network-config"), &network_config)?;
-
-    // Create cloud-init ISO
-    let ci_iso = vm_dir.join("ci.iso");
     if !json {
         info!("Creating cloud-init configuration");
     }
-    crate::util::run_command_quietly(
-        "genisoimage",
-        &[
-            "-output",
-            ci_iso.to_str().unwrap(),
-            "-volid",
-            "cidata",
-            "-joliet",
-            "-rock",
-            ci_dir.to_str().unwrap(),
-        ],
-    )?;
+    crate::cloud_init::build_seed_iso(&vm_dir, name, &mac, &subnet, cloud_init)?;
 
     // Per-VM network namespace. Everything below — tap, iptables,
     // forwarding, the CH process itself — lives inside a dedicated
@@ -407,16 +904,16 @@ ethernets:
         r#"#!/bin/bash
 cd "{vmdir}"
 sudo bash -c '
-  ip netns exec {netns} {ch} \
+  {swtpm}{limits}ip netns exec {netns} {ch} \
     --api-socket path={vmdir}/api.sock \
     --console off \
     --serial tty \
     --kernel "{fw}" \
     --cpus boot={cpus} \
-    --memory size={mem} \
+    --memory size={mem}{membacking} \
     --disk path={vmdir}/rootfs.qcow2,image_type=qcow2,backing_files=on path="{vmdir}/ci.iso" \
     --net tap={tap},mac={mac} \
-    --rng src=/dev/urandom{devsec} \
+    --rng src=/dev/urandom{devsec}{tpm} \
     > "{vmdir}/ch.log" 2>&1 &
   echo $! > "{vmdir}/pid"
   # File is root-owned; relax so the host user can read/delete.
@@ -434,14 +931,18 @@ fi
 sudo chmod 0666 "{vmdir}/api.sock" 2>/dev/null || true
 "#,
         vmdir = vm_dir.display(),
+        limits = resources.host_limits.systemd_run_prefix(),
         netns = netns_spec.netns,
         ch = config.ch_bin.display(),
         fw = config.fw_bin.display(),
         cpus = resources.cpus,
         mem = resources.memory,
+        membacking = resources.memory_backing.ch_memory_params(),
         tap = tap_name,
         mac = mac,
         devsec = device_section,
+        swtpm = resources.swtpm_command(&vm_dir),
+        tpm = resources.ch_tpm_args(&vm_dir),
     );
 
     let start_script_path = vm_dir.join("start.sh");
@@ -507,6 +1008,7 @@ pub async fn list(config: &Config, json: bool) -> Result<()> {
             let memory = get_vm_memory(config, &name).unwrap_or_else(|_| config.mem.clone());
             let disk = get_vm_disk_size(config, &name).unwrap_or_else(|_| config.disk_size.clone());
             let devices = get_vm_devices(config, &name);
+            let notes = get_vm_notes(config, &name);
 
             // Get creation time from directory metadata
             let created = match fs::metadata(&path) {
@@ -534,6 +1036,7 @@ pub async fn list(config: &Config, json: bool) -> Result<()> {
                 disk,
                 devices,
                 created,
+                notes,
             });
         }
     }
@@ -553,7 +1056,7 @@ pub async fn list(config: &Config, json: bool) -> Result<()> {
 
         // Print header
         println!(
-            "{:<width$} {:<10} {:<15} {:<7} {:<10} {:<10} {:<10} {:<20}",
+            "{:<width$} {:<10} {:<15} {:<7} {:<10} {:<10} {:<10} {:<20} notes",
             "name",
             "state",
             "ip",
@@ -577,7 +1080,7 @@ pub async fn list(config: &Config, json: bool) -> Result<()> {
                 format!("{}", vm.devices.len())
             };
             println!(
-                "{:<width$} {:<10} {:<15} {:<7} {:<10} {:<10} {:<10} {:<20}",
+                "{:<width$} {:<10} {:<15} {:<7} {:<10} {:<10} {:<10} {:<20} {}",
                 vm.name,
                 vm.state,
                 vm.ip,
@@ -586,6 +1089,7 @@ pub async fn list(config: &Config, json: bool) -> Result<()> {
                 vm.disk,
                 devices_display,
                 vm.created,
+                vm.notes.as_deref().unwrap_or("-"),
                 width = max_name_width
             );
         }
@@ -643,6 +1147,12 @@ pub async fn get(config: &Config, name: &str, json: bool) -> Result<()> {
             get_vm_memory(config, name).unwrap_or_else(|_| config.mem.clone()),
         ),
     );
+    if let Ok(backing) = fs::read_to_string(vm_dir.join("memory_backing")) {
+        details.insert(
+            "memory_backing".to_string(),
+            serde_json::Value::String(backing.trim().to_string()),
+        );
+    }
     details.insert(
         "disk_size".to_string(),
         serde_json::Value::String(
@@ -664,6 +1174,10 @@ pub async fn get(config: &Config, name: &str, json: bool) -> Result<()> {
         );
     }
 
+    if let Some(notes) = get_vm_notes(config, name) {
+        details.insert("notes".to_string(), serde_json::Value::String(notes));
+    }
+
     // Add VM directory path
     details.insert(
         "vm_dir".to_string(),
@@ -953,7 +1467,13 @@ pub async fn delete(config: &Config, name: &str, json: bool) -> Result<()> {
     Ok(())
 }
 
-pub async fn ip(config: &Config, name: &str, json: bool) -> Result<()> {
+pub async fn ip(
+    config: &Config,
+    name: &str,
+    source: IpSource,
+    subnet: Option<&str>,
+    json: bool,
+) -> Result<()> {
     let vm_dir = config.vm_dir(name);
 
     if !vm_dir.exists() {
@@ -965,7 +1485,7 @@ pub async fn ip(config: &Config, name: &str, json: bool) -> Result<()> {
     // back to the guest's baked-in IP. Returning the guest IP for a
     // netns-backed VM was misleading — that address is reachable
     // only from inside the VM's own netns.
-    let ip = read_display_ip(&vm_dir).map_or_else(|| get_vm_ip(config, name), Ok)?;
+    let ip = select_ip(config, name, source, subnet)?;
 
     if json {
         let result = serde_json::json!({
@@ -980,6 +1500,44 @@ pub async fn ip(config: &Config, name: &str, json: bool) -> Result<()> {
     Ok(())
 }
 
+/// `meda logs`: the VM's `ch.log`, which holds the guest's serial
+/// console (kernel and cloud-init boot output) alongside
+/// cloud-hypervisor's own messages. It is written for every VM, so a
+/// guest that booted but never came up on SSH can be diagnosed after
+/// the fact.
+pub fn logs(config: &Config, name: &str, tail: Option<usize>, json: bool) -> Result<()> {
+    let vm_dir = config.vm_dir(name);
+    if !vm_dir.exists() {
+        return Err(Error::VmNotFound(name.to_string()));
+    }
+    let path = vm_dir.join("ch.log");
+    let body = fs::read_to_string(&path).map_err(|_| {
+        Error::Other(format!(
+            "VM {} has no boot log yet ({} is missing; was it ever started?)",
+            name,
+            path.display()
+        ))
+    })?;
+    let lines = match tail {
+        Some(count) => crate::diagnostics::tail(&body, count),
+        None => body.lines().collect(),
+    };
+
+    if json {
+        let result = serde_json::json!({
+            "vm": name,
+            "path": path,
+            "lines": lines,
+        });
+        println!("{}", serde_json::to_string_pretty(&result)?);
+    } else {
+        for line in lines {
+            println!("{}", line);
+        }
+    }
+    Ok(())
+}
+
 pub fn check_vm_running(config: &Config, name: &str) -> Result<bool> {
     let vm_dir = config.vm_dir(name);
     let pid_file = vm_dir.join("pid");
@@ -1006,6 +1564,16 @@ pub fn check_vm_running(config: &Config, name: &str) -> Result<bool> {
 ///   3. None — caller falls back to the guest IP baked in the VM's
 ///      disk via `get_vm_ip`.
 fn read_display_ip(vm_dir: &std::path::Path) -> Option<String> {
+    display_ip_candidates(vm_dir)
+        .into_iter()
+        .next()
+        .map(|(_, ip)| ip)
+}
+
+/// Every display IP a VM has recorded, in [`read_display_ip`] priority
+/// order, tagged with where it came from.
+fn display_ip_candidates(vm_dir: &std::path::Path) -> Vec<(IpSource, String)> {
+    let mut candidates = Vec::new();
     // Per-VM netns layout (the current default): users reach the
     // guest at the veth's netns-side IP, not the guest's baked-in
     // IP. iptables inside the netns DNATs it to the guest. This is
@@ -1014,21 +1582,125 @@ fn read_display_ip(vm_dir: &std::path::Path) -> Option<String> {
     if let Ok(body) = fs::read_to_string(vm_dir.join("netns.json")) {
         if let Ok(v) = serde_json::from_str::<serde_json::Value>(&body) {
             if let Some(ip) = v.get("netns_ip").and_then(|v| v.as_str()) {
-                return Some(ip.to_string());
+                candidates.push((IpSource::Netns, ip.to_string()));
             }
         }
     }
     if let Ok(ip) = fs::read_to_string(vm_dir.join("guest_ip")) {
         let ip = ip.trim();
         if !ip.is_empty() {
-            return Some(ip.to_string());
+            candidates.push((IpSource::Guest, ip.to_string()));
         }
     }
-    let body = fs::read_to_string(vm_dir.join("smoltcp_forward")).ok()?;
-    body.split_whitespace()
-        .next()
-        .map(|s| s.trim().to_string())
+    if let Some(forward) = fs::read_to_string(vm_dir.join("smoltcp_forward"))
+        .ok()
+        .and_then(|body| body.split_whitespace().next().map(|s| s.trim().to_string()))
         .filter(|s| !s.is_empty())
+    {
+        candidates.push((IpSource::Forward, forward));
+    }
+    candidates
+}
+
+/// Which of a VM's addresses `meda ip` reports. On multi-homed hosts
+/// the default pick may not be reachable from where the caller runs,
+/// so they can ask for a specific one.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum IpSource {
+    /// First available, in `meda list` priority order.
+    #[default]
+    Auto,
+    /// The netns-side veth IP.
+    Netns,
+    /// The in-guest IP assigned by the reconfig agent.
+    Guest,
+    /// The host-side smoltcp forward.
+    Forward,
+    /// The static `<subnet>.2` baked in by cloud-init.
+    Static,
+}
+
+impl IpSource {
+    pub fn parse(value: &str) -> Result<Self> {
+        match value.to_ascii_lowercase().as_str() {
+            "auto" => Ok(Self::Auto),
+            "netns" => Ok(Self::Netns),
+            "guest" => Ok(Self::Guest),
+            "forward" => Ok(Self::Forward),
+            "static" => Ok(Self::Static),
+            other => Err(Error::Other(format!(
+                "Unknown IP source '{}' (expected auto, netns, guest, forward or static)",
+                other
+            ))),
+        }
+    }
+}
+
+/// Whether `ip` (optionally `ip:port`) falls inside IPv4 `cidr`.
+fn ip_in_subnet(ip: &str, cidr: &str) -> Result<bool> {
+    let invalid = || {
+        Error::Other(format!(
+            "Invalid subnet '{}' (expected e.g. 10.0.0.0/8)",
+            cidr
+        ))
+    };
+    let (network, prefix) = cidr.split_once('/').ok_or_else(invalid)?;
+    let network: std::net::Ipv4Addr = network.parse().map_err(|_| invalid())?;
+    let prefix: u32 = prefix
+        .parse()
+        .ok()
+        .filter(|p| *p <= 32)
+        .ok_or_else(invalid)?;
+    let host = ip.split(':').next().unwrap_or(ip);
+    let Ok(addr) = host.parse::<std::net::Ipv4Addr>() else {
+        return Ok(false);
+    };
+    let mask = u32::MAX.checked_shl(32 - prefix).unwrap_or(0);
+    Ok(u32::from(addr) & mask == u32::from(network) & mask)
+}
+
+/// Pick an address for `name` from `source`, optionally restricted to
+/// `subnet` (CIDR). Errors list what was available so a mismatch is
+/// easy to diagnose.
+pub fn select_ip(
+    config: &Config,
+    name: &str,
+    source: IpSource,
+    subnet: Option<&str>,
+) -> Result<String> {
+    let mut candidates = display_ip_candidates(&config.vm_dir(name));
+    if let Ok(ip) = get_vm_ip(config, name) {
+        candidates.push((IpSource::Static, ip));
+    }
+
+    for (candidate_source, ip) in &candidates {
+        if source != IpSource::Auto && *candidate_source != source {
+            continue;
+        }
+        if let Some(subnet) = subnet {
+            if !ip_in_subnet(ip, subnet)? {
+                continue;
+            }
+        }
+        return Ok(ip.clone());
+    }
+
+    let available = candidates
+        .iter()
+        .map(|(source, ip)| format!("{:?}={}", source, ip).to_lowercase())
+        .collect::<Vec<_>>()
+        .join(", ");
+    Err(Error::Other(format!(
+        "No {:?} IP{} for VM {} (available: {})",
+        source,
+        subnet.map(|s| format!(" in {}", s)).unwrap_or_default(),
+        name,
+        if available.is_empty() {
+            "none"
+        } else {
+            &available
+        }
+    )))
 }
 
 pub fn get_vm_ip(config: &Config, name: &str) -> Result<String> {
@@ -1305,6 +1977,45 @@ mod tests {
         assert_eq!(ip, "192.168.100.2");
     }
 
+    #[test]
+    fn test_select_ip_by_source_and_subnet() {
+        let (config, _temp_dir) = setup_test_config();
+
+        let vm_dir = config.vm_dir("test-vm");
+        std::fs::create_dir_all(&vm_dir).unwrap();
+        std::fs::write(vm_dir.join("subnet"), "192.168.100").unwrap();
+        std::fs::write(vm_dir.join("netns.json"), r#"{"netns_ip":"10.99.42.2"}"#).unwrap();
+
+        // Auto keeps the `meda list` priority
+        assert_eq!(
+            select_ip(&config, "test-vm", IpSource::Auto, None).unwrap(),
+            "10.99.42.2"
+        );
+        assert_eq!(
+            select_ip(&config, "test-vm", IpSource::Static, None).unwrap(),
+            "192.168.100.2"
+        );
+        assert_eq!(
+            select_ip(&config, "test-vm", IpSource::Auto, Some("192.168.0.0/16")).unwrap(),
+            "192.168.100.2"
+        );
+
+        let err = select_ip(&config, "test-vm", IpSource::Guest, None)
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("netns=10.99.42.2"));
+        assert!(select_ip(&config, "test-vm", IpSource::Auto, Some("bogus")).is_err());
+    }
+
+    #[test]
+    fn test_ip_in_subnet() {
+        assert!(ip_in_subnet("10.1.2.3", "10.0.0.0/8").unwrap());
+        assert!(ip_in_subnet("127.0.0.1:2222", "127.0.0.0/8").unwrap());
+        assert!(!ip_in_subnet("192.168.1.2", "10.0.0.0/8").unwrap());
+        assert!(ip_in_subnet("192.168.1.2", "0.0.0.0/0").unwrap());
+        assert!(ip_in_subnet("10.0.0.1", "10.0.0.0/33").is_err());
+    }
+
     #[test]
     fn test_get_vm_memory_no_start_script() {
         let (config, _temp_dir) = setup_test_config();
@@ -1390,4 +2101,193 @@ mod tests {
         assert!(result.is_err());
         assert!(matches!(result.unwrap_err(), Error::VmNotFound(_)));
     }
+
+    #[test]
+    fn test_memory_backing_parse() {
+        assert_eq!(
+            MemoryBacking::parse("default").unwrap(),
+            MemoryBacking::Anonymous
+        );
+        assert_eq!(
+            MemoryBacking::parse("Hugepages").unwrap(),
+            MemoryBacking::Hugepages
+        );
+        assert_eq!(MemoryBacking::parse("file").unwrap(), MemoryBacking::Shared);
+        assert!(MemoryBacking::parse("numa").is_err());
+        assert_eq!(MemoryBacking::Hugepages.ch_memory_params(), ",hugepages=on");
+        assert_eq!(MemoryBacking::Anonymous.ch_memory_params(), "");
+    }
+
+    #[test]
+    fn test_host_limits() {
+        let limits = HostLimits::parse(Some("150%"), Some("2G")).unwrap();
+        assert_eq!(limits.cpu_quota, Some(150));
+        assert_eq!(limits.memory_max, Some(2 * 1024 * 1024 * 1024));
+        let prefix = limits.systemd_run_prefix();
+        assert!(prefix.starts_with("systemd-run "));
+        assert!(prefix.contains("--scope"));
+        assert!(prefix.contains("-p CPUQuota=150%"));
+        assert!(prefix.contains("-p MemoryMax=2147483648"));
+
+        assert_eq!(
+            HostLimits::parse(None, None).unwrap().systemd_run_prefix(),
+            ""
+        );
+        assert!(HostLimits::parse(Some("0%"), None).is_err());
+        assert!(HostLimits::parse(Some("lots"), None).is_err());
+        assert!(HostLimits::parse(None, Some("2X")).is_err());
+    }
+
+    #[test]
+    fn test_host_limits_placement() {
+        assert!(valid_cpuset("0-3,8,10-11"));
+        assert!(valid_cpuset("5"));
+        assert!(!valid_cpuset(""));
+        assert!(!valid_cpuset("3-1"));
+        assert!(!valid_cpuset("0,,1"));
+        assert!(!valid_cpuset("a-b"));
+
+        let limits = HostLimits::default()
+            .with_placement(Some("2-5"), None)
+            .unwrap();
+        assert!(!limits.is_empty());
+        assert!(limits.systemd_run_prefix().contains("-p AllowedCPUs=2-5 "));
+        assert!(HostLimits::default()
+            .with_placement(Some("0-"), None)
+            .is_err());
+
+        // Placement layers on top of parsed caps.
+        let parsed = HostLimits::parse(Some("200%"), None).unwrap();
+        assert!(!parsed.has_placement());
+        let prefix = parsed
+            .with_placement(Some("0-1"), None)
+            .unwrap()
+            .systemd_run_prefix();
+        assert!(prefix.contains("-p CPUQuota=200%"));
+        assert!(prefix.contains("-p AllowedCPUs=0-1 "));
+
+        let temp_dir = TempDir::new().unwrap();
+        limits.store_placement(temp_dir.path()).unwrap();
+        assert_eq!(
+            fs::read_to_string(temp_dir.path().join("placement")).unwrap(),
+            "cpus=2-5\n"
+        );
+        HostLimits::default()
+            .store_placement(&temp_dir.path().join("none"))
+            .unwrap();
+        assert!(!temp_dir.path().join("none").exists());
+    }
+
+    #[test]
+    fn test_tpm_start_script_parts() {
+        let (config, _temp_dir) = setup_test_config();
+        let vm_dir = std::path::Path::new("/vms/secure");
+        let resources = VmResources::from_config_with_overrides(&config, None, None, None, vec![]);
+        assert_eq!(resources.swtpm_command(vm_dir), "");
+        assert_eq!(resources.ch_tpm_args(vm_dir), "");
+
+        let resources = resources.with_tpm(true);
+        let swtpm = resources.swtpm_command(vm_dir);
+        assert!(swtpm.contains("swtpm socket --tpm2 --tpmstate dir=\"/vms/secure/tpm\""));
+        assert!(swtpm.contains("path=\"/vms/secure/swtpm.sock\""));
+        assert!(swtpm.contains("--terminate"));
+        assert!(resources
+            .ch_tpm_args(vm_dir)
+            .ends_with("--tpm socket=\"/vms/secure/swtpm.sock\""));
+    }
+
+    #[test]
+    fn test_with_memory_options_validates_swap() {
+        let (config, _temp_dir) = setup_test_config();
+        let base = VmResources::from_config_with_overrides(&config, None, None, None, vec![]);
+
+        let resources = base
+            .clone()
+            .with_memory_options(Some("shared"), Some("512M"))
+            .unwrap();
+        assert_eq!(resources.memory_backing, MemoryBacking::Shared);
+        assert_eq!(resources.swap_size.as_deref(), Some("536870912"));
+        let resources = base
+            .clone()
+            .with_memory_options(None, Some("2GiB"))
+            .unwrap();
+        assert_eq!(resources.swap_size.as_deref(), Some("2147483648"));
+
+        assert!(base.clone().with_memory_options(None, Some("0G")).is_err());
+        assert!(base.with_memory_options(None, Some("lots")).is_err());
+    }
+
+    #[test]
+    fn test_default_user_data_swap_section() {
+        let defaults = CloudInitOptions::default();
+        let without = default_user_data("ssh-ed25519 AAAA test", None, &defaults);
+        assert!(without.contains("ssh-ed25519 AAAA test"));
+        assert!(!without.contains("swap:"));
+
+        let with = default_user_data("ssh-ed25519 AAAA test", Some("2G"), &defaults);
+        assert!(with.contains("swap:\n  filename: /swap.img\n  size: 2G"));
+    }
+
+    #[test]
+    fn test_store_notes() {
+        let temp_dir = TempDir::new().unwrap();
+        store_notes(temp_dir.path(), "packer build web (template web.pkr.hcl)").unwrap();
+        assert_eq!(
+            fs::read_to_string(temp_dir.path().join("notes")).unwrap(),
+            "packer build web (template web.pkr.hcl)"
+        );
+        store_notes(temp_dir.path(), "").unwrap();
+        assert!(!temp_dir.path().join("notes").exists());
+
+        assert!(store_notes(temp_dir.path(), "two\nlines").is_err());
+        assert!(check_notes(&"x".repeat(MAX_NOTES_LEN + 1)).is_err());
+    }
+
+    #[test]
+    fn test_default_user_data_extra_authorized_keys() {
+        let key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHw4qsecUqGtXKKSO4wYcWG0nzoz5J9e2oBhb+jqBokY alice: laptop";
+        let options = CloudInitOptions::default()
+            .with_authorized_keys(vec![key.to_string()])
+            .unwrap();
+        let user_data = default_user_data("ssh-ed25519 AAAA test", None, &options);
+        assert!(user_data.contains(&format!(
+            "    ssh_authorized_keys:\n      - ssh-ed25519 AAAA test\n      - \"{}\"\nssh_pwauth: true\n",
+            key
+        )));
+    }
+
+    #[test]
+    fn test_default_user_data_credentials() {
+        // A configured user without a password is key-only
+        let key_only = CloudInitOptions::default()
+            .with_credentials(Some("builder"), None)
+            .unwrap();
+        let user_data = default_user_data("ssh-ed25519 AAAA test", None, &key_only);
+        assert!(user_data.contains("- name: builder"));
+        assert!(user_data.contains("lock_passwd: true"));
+        assert!(user_data.contains("ssh_pwauth: false"));
+        assert!(!user_data.contains("chpasswd"));
+        assert!(!user_data.contains("name: cirun"));
+
+        let with_password = CloudInitOptions::default()
+            .with_credentials(Some("builder"), Some("pa\"ss"))
+            .unwrap();
+        let user_data = default_user_data("ssh-ed25519 AAAA test", None, &with_password);
+        assert!(user_data.contains("ssh_pwauth: true"));
+        assert!(user_data.contains("password: \"pa\\\"ss\""));
+    }
+
+    #[test]
+    fn test_guest_user_defaults_to_cirun() {
+        let (config, _temp_dir) = setup_test_config();
+        let vm_dir = config.vm_dir("test-vm");
+        std::fs::create_dir_all(&vm_dir).unwrap();
+        assert_eq!(guest_user(&config, "test-vm"), "cirun");
+
+        let options = CloudInitOptions::default()
+            .with_credentials(Some("builder"), None)
+            .unwrap();
+        store_guest_user(&vm_dir, &options).unwrap();
+        assert_eq!(guest_user(&config, "test-vm"), "builder");
+    }
 }